@@ -0,0 +1,382 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// WeightAnnotation is the endpoint annotation holding an endpoint's
+// weight for WeightedRandomLoadBalancer.
+const WeightAnnotation = "weight"
+
+// hashReplicas is the number of points each endpoint occupies on the
+// consistent hash ring.
+const hashReplicas = 100
+
+// A RequestLoadBalancer is a LoadBalancer that picks endpoints based on
+// the request being sent. Transport calls NextRequest instead of Next.
+type RequestLoadBalancer interface {
+	LoadBalancer
+
+	NextRequest(r *http.Request) (Endpoint, error)
+}
+
+// A TrackingLoadBalancer is a LoadBalancer that tracks outstanding
+// requests. Transport calls Done once a request to an endpoint returned
+// by Next has finished and its response body has been closed.
+type TrackingLoadBalancer interface {
+	LoadBalancer
+
+	Done(endpoint Endpoint)
+}
+
+// A LoadBalancingStrategy selects the LoadBalancer used for a service.
+type LoadBalancingStrategy int
+
+const (
+	// RoundRobin uses a RoundRobinLoadBalancer.
+	RoundRobin LoadBalancingStrategy = iota
+
+	// LeastRequests uses a LeastRequestsLoadBalancer.
+	LeastRequests
+
+	// WeightedRandom uses a WeightedRandomLoadBalancer.
+	WeightedRandom
+
+	// ConsistentHash uses a ConsistentHashLoadBalancer.
+	ConsistentHash
+)
+
+// A LoadBalancingPolicy configures how Transport balances requests
+// across the endpoints of a service.
+type LoadBalancingPolicy struct {
+	Strategy LoadBalancingStrategy
+
+	// HashHeader names the request header hashed by the ConsistentHash
+	// strategy.
+	HashHeader string
+
+	// Filter optionally restricts the service's endpoints using a
+	// Service Directory filter expression, such as
+	// `annotations.version="v2"` to route only to a canary.
+	Filter string
+
+	// Prefer optionally routes requests to endpoints whose annotations
+	// have all the given values, such as {"zone": "us-central1-a"} for
+	// zone-local routing. Endpoints registered with RegisterEndpoint
+	// carry a ZoneAnnotation. If no endpoint matches, all endpoints are
+	// used.
+	Prefer map[string]string
+}
+
+// newLoadBalancer returns a load balancer for the named service using
+// the given policy.
+func newLoadBalancer(ctx context.Context, env *Environment, name, namespace string, policy LoadBalancingPolicy) (LoadBalancer, error) {
+	switch policy.Strategy {
+	case RoundRobin:
+		return newRoundRobinLoadBalancer(ctx, env, name, namespace, policy.Filter)
+	case LeastRequests:
+		return newLeastRequestsLoadBalancer(ctx, env, name, namespace, policy.Filter)
+	case WeightedRandom:
+		return newWeightedRandomLoadBalancer(ctx, env, name, namespace, policy.Filter)
+	case ConsistentHash:
+		return newConsistentHashLoadBalancer(ctx, env, name, namespace, policy.Filter, policy.HashHeader)
+	default:
+		return nil, fmt.Errorf("run: unknown load balancing strategy %d", policy.Strategy)
+	}
+}
+
+// endpointKey identifies an endpoint across refreshes.
+func endpointKey(endpoint Endpoint) string {
+	if endpoint.Name != "" {
+		return endpoint.Name
+	}
+	return fmt.Sprintf("%s:%d", endpoint.Address, endpoint.Port)
+}
+
+// LeastRequestsLoadBalancer sends each request to the less busy of two
+// randomly chosen endpoints, measured by the number of outstanding
+// requests. It is safe for concurrent use.
+type LeastRequestsLoadBalancer struct {
+	*endpointRefresher
+
+	mu          sync.Mutex
+	endpoints   []Endpoint
+	outstanding map[string]int
+}
+
+// NewLeastRequestsLoadBalancer returns a load balancer for the named
+// Service Directory service in the given namespace.
+func NewLeastRequestsLoadBalancer(name, namespace string) (*LeastRequestsLoadBalancer, error) {
+	return newLeastRequestsLoadBalancer(context.Background(), DefaultEnvironment, name, namespace, "")
+}
+
+// NewLeastRequestsLoadBalancerContext is like
+// NewLeastRequestsLoadBalancer but stops refreshing endpoints when ctx
+// is done.
+func NewLeastRequestsLoadBalancerContext(ctx context.Context, name, namespace string) (*LeastRequestsLoadBalancer, error) {
+	return newLeastRequestsLoadBalancer(ctx, DefaultEnvironment, name, namespace, "")
+}
+
+func newLeastRequestsLoadBalancer(ctx context.Context, env *Environment, name, namespace, filter string) (*LeastRequestsLoadBalancer, error) {
+	loadBalancer := &LeastRequestsLoadBalancer{outstanding: make(map[string]int)}
+
+	refresher, err := newEndpointRefresher(ctx, env, name, namespace, filter, loadBalancer.setEndpoints)
+	if err != nil {
+		return nil, err
+	}
+	loadBalancer.endpointRefresher = refresher
+
+	go loadBalancer.RefreshEndpoints()
+
+	return loadBalancer, nil
+}
+
+// Next returns the endpoint with fewer outstanding requests of two
+// chosen at random and counts the request against it. Callers must
+// call Done when the request finishes.
+func (lb *LeastRequestsLoadBalancer) Next() (Endpoint, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if len(lb.endpoints) == 0 {
+		return Endpoint{}, ErrNoEndpoints
+	}
+
+	endpoint := lb.endpoints[0]
+	if n := len(lb.endpoints); n > 1 {
+		i, j := rand.Intn(n), rand.Intn(n-1)
+		if j >= i {
+			j++
+		}
+
+		endpoint = lb.endpoints[i]
+		if lb.outstanding[endpointKey(lb.endpoints[j])] < lb.outstanding[endpointKey(endpoint)] {
+			endpoint = lb.endpoints[j]
+		}
+	}
+
+	lb.outstanding[endpointKey(endpoint)]++
+	return endpoint, nil
+}
+
+// Done records that a request to endpoint has finished.
+func (lb *LeastRequestsLoadBalancer) Done(endpoint Endpoint) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	key := endpointKey(endpoint)
+	if lb.outstanding[key] <= 1 {
+		delete(lb.outstanding, key)
+		return
+	}
+	lb.outstanding[key]--
+}
+
+func (lb *LeastRequestsLoadBalancer) setEndpoints(endpoints []Endpoint) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.endpoints = endpoints
+}
+
+// WeightedRandomLoadBalancer sends each request to a random endpoint
+// chosen in proportion to the integer weight in the endpoint's "weight"
+// annotation. Endpoints without a valid weight have a weight of 1, and
+// endpoints with a weight of 0 receive no requests. It is safe for
+// concurrent use.
+type WeightedRandomLoadBalancer struct {
+	*endpointRefresher
+
+	mu        sync.Mutex
+	endpoints []Endpoint
+	weights   []int
+	total     int
+}
+
+// NewWeightedRandomLoadBalancer returns a load balancer for the named
+// Service Directory service in the given namespace.
+func NewWeightedRandomLoadBalancer(name, namespace string) (*WeightedRandomLoadBalancer, error) {
+	return newWeightedRandomLoadBalancer(context.Background(), DefaultEnvironment, name, namespace, "")
+}
+
+// NewWeightedRandomLoadBalancerContext is like
+// NewWeightedRandomLoadBalancer but stops refreshing endpoints when ctx
+// is done.
+func NewWeightedRandomLoadBalancerContext(ctx context.Context, name, namespace string) (*WeightedRandomLoadBalancer, error) {
+	return newWeightedRandomLoadBalancer(ctx, DefaultEnvironment, name, namespace, "")
+}
+
+func newWeightedRandomLoadBalancer(ctx context.Context, env *Environment, name, namespace, filter string) (*WeightedRandomLoadBalancer, error) {
+	loadBalancer := &WeightedRandomLoadBalancer{}
+
+	refresher, err := newEndpointRefresher(ctx, env, name, namespace, filter, loadBalancer.setEndpoints)
+	if err != nil {
+		return nil, err
+	}
+	loadBalancer.endpointRefresher = refresher
+
+	go loadBalancer.RefreshEndpoints()
+
+	return loadBalancer, nil
+}
+
+func (lb *WeightedRandomLoadBalancer) Next() (Endpoint, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.total == 0 {
+		return Endpoint{}, ErrNoEndpoints
+	}
+
+	n := rand.Intn(lb.total)
+	for i, weight := range lb.weights {
+		if n < weight {
+			return lb.endpoints[i], nil
+		}
+		n -= weight
+	}
+
+	// Not reached; the weights sum to total.
+	return Endpoint{}, ErrNoEndpoints
+}
+
+func (lb *WeightedRandomLoadBalancer) setEndpoints(endpoints []Endpoint) {
+	weights := make([]int, len(endpoints))
+	total := 0
+	for i, endpoint := range endpoints {
+		weight, err := strconv.Atoi(endpoint.Annotations[WeightAnnotation])
+		if err != nil {
+			weight = 1
+		}
+		if weight < 0 {
+			weight = 0
+		}
+
+		weights[i] = weight
+		total += weight
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.endpoints = endpoints
+	lb.weights = weights
+	lb.total = total
+}
+
+// ConsistentHashLoadBalancer sends requests with the same value in a
+// request header to the same endpoint, so that sessions stick to an
+// endpoint. When endpoints are added or removed only the requests
+// hashed near them move. Requests without the header are sent to a
+// random endpoint. It is safe for concurrent use.
+type ConsistentHashLoadBalancer struct {
+	*endpointRefresher
+
+	header string
+
+	mu        sync.Mutex
+	endpoints []Endpoint
+	ring      []ringPoint
+}
+
+// A ringPoint places an endpoint on the consistent hash ring.
+type ringPoint struct {
+	hash     uint32
+	endpoint int
+}
+
+// NewConsistentHashLoadBalancer returns a load balancer that hashes the
+// named request header.
+func NewConsistentHashLoadBalancer(name, namespace, header string) (*ConsistentHashLoadBalancer, error) {
+	return newConsistentHashLoadBalancer(context.Background(), DefaultEnvironment, name, namespace, "", header)
+}
+
+// NewConsistentHashLoadBalancerContext is like
+// NewConsistentHashLoadBalancer but stops refreshing endpoints when ctx
+// is done.
+func NewConsistentHashLoadBalancerContext(ctx context.Context, name, namespace, header string) (*ConsistentHashLoadBalancer, error) {
+	return newConsistentHashLoadBalancer(ctx, DefaultEnvironment, name, namespace, "", header)
+}
+
+func newConsistentHashLoadBalancer(ctx context.Context, env *Environment, name, namespace, filter, header string) (*ConsistentHashLoadBalancer, error) {
+	if header == "" {
+		return nil, fmt.Errorf("run: consistent hash load balancer for %s.%s requires a header", name, namespace)
+	}
+
+	loadBalancer := &ConsistentHashLoadBalancer{header: header}
+
+	refresher, err := newEndpointRefresher(ctx, env, name, namespace, filter, loadBalancer.setEndpoints)
+	if err != nil {
+		return nil, err
+	}
+	loadBalancer.endpointRefresher = refresher
+
+	go loadBalancer.RefreshEndpoints()
+
+	return loadBalancer, nil
+}
+
+// Next returns a random endpoint.
+func (lb *ConsistentHashLoadBalancer) Next() (Endpoint, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if len(lb.endpoints) == 0 {
+		return Endpoint{}, ErrNoEndpoints
+	}
+	return lb.endpoints[rand.Intn(len(lb.endpoints))], nil
+}
+
+// NextRequest returns the endpoint for the value of the request's hash
+// header, or a random endpoint if the header is not set.
+func (lb *ConsistentHashLoadBalancer) NextRequest(r *http.Request) (Endpoint, error) {
+	value := r.Header.Get(lb.header)
+	if value == "" {
+		return lb.Next()
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if len(lb.ring) == 0 {
+		return Endpoint{}, ErrNoEndpoints
+	}
+
+	hash := hashString(value)
+	i := sort.Search(len(lb.ring), func(i int) bool { return lb.ring[i].hash >= hash })
+	if i == len(lb.ring) {
+		i = 0
+	}
+
+	return lb.endpoints[lb.ring[i].endpoint], nil
+}
+
+func (lb *ConsistentHashLoadBalancer) setEndpoints(endpoints []Endpoint) {
+	ring := make([]ringPoint, 0, len(endpoints)*hashReplicas)
+	for i, endpoint := range endpoints {
+		key := endpointKey(endpoint)
+		for j := 0; j < hashReplicas; j++ {
+			ring = append(ring, ringPoint{hashString(fmt.Sprintf("%s#%d", key, j)), i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.endpoints = endpoints
+	lb.ring = ring
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,303 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+// balancerEnvironment returns an Environment whose Service Directory
+// holds the given endpoints for the "test" service in the "test"
+// namespace.
+func balancerEnvironment(t *testing.T, endpoints []gcptest.Endpoint) *Environment {
+	t.Helper()
+
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "test", endpoints)
+
+	return serviceDirectoryEnvironment(t, sd)
+}
+
+var balancerTestEndpoints = []gcptest.Endpoint{
+	{Name: "test-10-0-0-1", Address: "10.0.0.1", Port: 8080},
+	{Name: "test-10-0-0-2", Address: "10.0.0.2", Port: 8080},
+	{Name: "test-10-0-0-3", Address: "10.0.0.3", Port: 8080},
+}
+
+func TestLeastRequestsLoadBalancer(t *testing.T) {
+	e := balancerEnvironment(t, balancerTestEndpoints[:2])
+
+	lb, err := newLeastRequestsLoadBalancer(context.Background(), e, "test", "test", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lb.Close()
+
+	// With two endpoints both are always compared, so outstanding
+	// requests alternate between them.
+	counts := make(map[string]int)
+	var endpoints []Endpoint
+	for i := 0; i < 10; i++ {
+		endpoint, err := lb.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		counts[endpoint.Name]++
+		endpoints = append(endpoints, endpoint)
+	}
+
+	for _, endpoint := range balancerTestEndpoints[:2] {
+		if counts[endpoint.Name] != 5 {
+			t.Errorf("%s request count mismatch; want 5, got %d", endpoint.Name, counts[endpoint.Name])
+		}
+	}
+
+	for _, endpoint := range endpoints {
+		lb.Done(endpoint)
+	}
+
+	if n := len(lb.outstanding); n != 0 {
+		t.Errorf("outstanding endpoints mismatch; want 0, got %d", n)
+	}
+}
+
+func TestWeightedRandomLoadBalancer(t *testing.T) {
+	endpoints := []gcptest.Endpoint{
+		{Name: "test-10-0-0-1", Address: "10.0.0.1", Port: 8080, Annotations: map[string]string{"weight": "0"}},
+		{Name: "test-10-0-0-2", Address: "10.0.0.2", Port: 8080, Annotations: map[string]string{"weight": "3"}},
+		{Name: "test-10-0-0-3", Address: "10.0.0.3", Port: 8080},
+	}
+	e := balancerEnvironment(t, endpoints)
+
+	lb, err := newWeightedRandomLoadBalancer(context.Background(), e, "test", "test", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lb.Close()
+
+	if lb.total != 4 {
+		t.Errorf("total weight mismatch; want 4, got %d", lb.total)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		endpoint, err := lb.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		counts[endpoint.Name]++
+	}
+
+	if n := counts["test-10-0-0-1"]; n != 0 {
+		t.Errorf("zero weight endpoint request count mismatch; want 0, got %d", n)
+	}
+	if counts["test-10-0-0-2"] <= counts["test-10-0-0-3"] {
+		t.Errorf("weighted endpoint received fewer requests; got %v", counts)
+	}
+}
+
+func TestWeightedRandomLoadBalancerNoWeight(t *testing.T) {
+	endpoints := []gcptest.Endpoint{
+		{Name: "test-10-0-0-1", Address: "10.0.0.1", Port: 8080, Annotations: map[string]string{"weight": "0"}},
+	}
+	e := balancerEnvironment(t, endpoints)
+
+	lb, err := newWeightedRandomLoadBalancer(context.Background(), e, "test", "test", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lb.Close()
+
+	if _, err := lb.Next(); err != ErrNoEndpoints {
+		t.Errorf("error mismatch; want %v, got %v", ErrNoEndpoints, err)
+	}
+}
+
+func TestConsistentHashLoadBalancer(t *testing.T) {
+	e := balancerEnvironment(t, balancerTestEndpoints)
+
+	lb, err := newConsistentHashLoadBalancer(context.Background(), e, "test", "test", "", "X-Session-ID")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lb.Close()
+
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest("GET", "http://test.test.run.local/", nil)
+		r.Header.Set("X-Session-ID", fmt.Sprintf("session-%d", i))
+
+		want, err := lb.NextRequest(r)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		seen[want.Name] = true
+
+		for j := 0; j < 5; j++ {
+			got, err := lb.NextRequest(r)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Name != want.Name {
+				t.Errorf("session-%d endpoint mismatch; want %s, got %s", i, want.Name, got.Name)
+			}
+		}
+	}
+
+	if len(seen) != len(balancerTestEndpoints) {
+		t.Errorf("endpoints used mismatch; want %d, got %d", len(balancerTestEndpoints), len(seen))
+	}
+
+	r := httptest.NewRequest("GET", "http://test.test.run.local/", nil)
+	if _, err := lb.NextRequest(r); err != nil {
+		t.Errorf("unexpected error without hash header: %v", err)
+	}
+}
+
+func TestConsistentHashLoadBalancerRequiresHeader(t *testing.T) {
+	e := balancerEnvironment(t, balancerTestEndpoints)
+
+	if _, err := newConsistentHashLoadBalancer(context.Background(), e, "test", "test", "", ""); err == nil {
+		t.Error("expected error for empty hash header")
+	}
+}
+
+func TestTransportLoadBalancingPolicy(t *testing.T) {
+	var hits [3]int32
+	var endpoints []gcptest.Endpoint
+	for i := range hits {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+		}))
+		defer ts.Close()
+
+		endpoints = append(endpoints, testEndpoint(t, ts))
+	}
+
+	tr := &Transport{
+		Environment: balancerEnvironment(t, endpoints),
+		LoadBalancing: map[string]LoadBalancingPolicy{
+			"test.test": {Strategy: ConsistentHash, HashHeader: "X-Session-ID"},
+		},
+	}
+	defer tr.Close()
+
+	httpClient := &http.Client{Transport: tr}
+
+	for i := 0; i < 10; i++ {
+		request, err := http.NewRequest("GET", "http://test.test.run.local/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("X-Session-ID", "session")
+
+		response, err := httpClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	var used int
+	for i := range hits {
+		if n := atomic.LoadInt32(&hits[i]); n != 0 {
+			used++
+			if n != 10 {
+				t.Errorf("backend %d request count mismatch; want 10, got %d", i, n)
+			}
+		}
+	}
+	if used != 1 {
+		t.Errorf("backends used mismatch; want 1, got %d", used)
+	}
+}
+
+func TestTransportLeastRequestsDone(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	tr := &Transport{
+		Environment: balancerEnvironment(t, []gcptest.Endpoint{testEndpoint(t, ts)}),
+		LoadBalancing: map[string]LoadBalancingPolicy{
+			"test.test": {Strategy: LeastRequests},
+		},
+	}
+	defer tr.Close()
+
+	response, err := (&http.Client{Transport: tr}).Get("http://test.test.run.local/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr.mu.Lock()
+	lb := tr.balancers["test.test"].lb.(*LeastRequestsLoadBalancer)
+	tr.mu.Unlock()
+
+	lb.mu.Lock()
+	n := len(lb.outstanding)
+	lb.mu.Unlock()
+	if n != 1 {
+		t.Errorf("outstanding endpoints before close mismatch; want 1, got %d", n)
+	}
+
+	response.Body.Close()
+
+	lb.mu.Lock()
+	n = len(lb.outstanding)
+	lb.mu.Unlock()
+	if n != 0 {
+		t.Errorf("outstanding endpoints after close mismatch; want 0, got %d", n)
+	}
+}
+
+func TestTransportLoadBalancingFilterAndPrefer(t *testing.T) {
+	var hits [3]int32
+	var endpoints []gcptest.Endpoint
+	for i, annotations := range []map[string]string{
+		{"version": "v1", "zone": "test-1"},
+		{"version": "v1", "zone": "test-2"},
+		{"version": "v2", "zone": "test-1"},
+	} {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+		}))
+		defer ts.Close()
+
+		endpoint := testEndpoint(t, ts)
+		endpoint.Annotations = annotations
+		endpoints = append(endpoints, endpoint)
+	}
+
+	tr := &Transport{
+		Environment: balancerEnvironment(t, endpoints),
+		LoadBalancing: map[string]LoadBalancingPolicy{
+			"test.test": {
+				Filter: `annotations.version="v1"`,
+				Prefer: map[string]string{"zone": "test-2"},
+			},
+		},
+	}
+	defer tr.Close()
+
+	for i := 0; i < 5; i++ {
+		response, err := (&http.Client{Transport: tr}).Get("http://test.test.run.local/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	want := [3]int32{0, 5, 0}
+	for i := range hits {
+		if n := atomic.LoadInt32(&hits[i]); n != want[i] {
+			t.Errorf("backend %d request count mismatch; want %d, got %d", i, want[i], n)
+		}
+	}
+}
@@ -1,16 +1,14 @@
 package run
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"time"
 )
 
-var cloudrunEndpoint = "https://%s-run.googleapis.com"
-
 // ErrNameResolutionPermissionDenied is returned when access to the
 // Cloud Run API is denied.
 var ErrNameResolutionPermissionDenied = errors.New("run: permission denied to named service")
@@ -19,7 +17,8 @@ var ErrNameResolutionPermissionDenied = errors.New("run: permission denied to na
 // Run API are unauthorized.
 var ErrNameResolutionUnauthorized = errors.New("run: cloud run api unauthorized")
 
-// ErrServiceNotFound is returned when a service is not found.
+// ErrServiceNotFound is returned when a Cloud Run or Service Directory
+// service is not found.
 var ErrServiceNotFound = errors.New("run: named service not found")
 
 // ErrNameResolutionUnknownError is return when calls to the Cloud Run
@@ -59,39 +58,42 @@ type ServiceAddress struct {
 	URL string `json:"url"`
 }
 
-func regionalEndpoint(region string) string {
+func (e *Environment) regionalEndpoint(region string) string {
 	if region == "test" {
-		return cloudrunEndpoint
+		return e.CloudRunEndpoint
 	}
-	return fmt.Sprintf(cloudrunEndpoint, region)
+	return fmt.Sprintf(e.CloudRunEndpoint, region)
 }
 
-func getService(name, region, project string) (*Service, error) {
+func (e *Environment) getService(ctx context.Context, name, region, project string) (*Service, error) {
 	var err error
 
+	ctx, cancel := e.withAPITimeout(ctx)
+	defer cancel()
+
 	if region == "" {
-		region, err = Region()
+		region, err = e.Region(ctx)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if project == "" {
-		project, err = ProjectID()
+		project, err = e.ProjectID(ctx)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	endpoint := fmt.Sprintf("%s/apis/serving.knative.dev/v1/namespaces/%s/services/%s",
-		regionalEndpoint(region), project, name)
+		e.regionalEndpoint(region), project, name)
 
-	token, err := Token([]string{"https://www.googleapis.com/auth/cloud-platform"})
+	token, err := e.Token(ctx, []string{"https://www.googleapis.com/auth/cloud-platform"})
 	if err != nil {
 		return nil, err
 	}
 
-	request, err := http.NewRequest("GET", endpoint, nil)
+	request, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -99,10 +101,7 @@ func getService(name, region, project string) (*Service, error) {
 	request.Header.Set("User-Agent", userAgent)
 	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
 
-	timeout := time.Duration(5) * time.Second
-	httpClient := &http.Client{Timeout: timeout}
-
-	response, err := httpClient.Do(request)
+	response, err := e.httpClient().Do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -1,19 +1,20 @@
 package run
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-var serviceDirectoryEndpoint = "https://servicedirectory.googleapis.com"
-
 type Endpoint struct {
 	Name        string            `json:"name"`
 	Address     string            `json:"address"`
@@ -24,257 +25,626 @@ type Endpoint struct {
 }
 
 type ListEndpoints struct {
-	Endpoints []Endpoint `json:"endpoints"`
+	Endpoints     []Endpoint `json:"endpoints"`
+	NextPageToken string     `json:"nextPageToken,omitempty"`
 }
 
+// endpointRefreshInterval is how often load balancers refresh their
+// endpoints from Service Directory.
+const endpointRefreshInterval = 10 * time.Second
+
+// ErrNoEndpoints is returned when a service has no endpoints
+// registered in Service Directory.
+var ErrNoEndpoints = errors.New("run: no endpoints available")
+
 type LoadBalancer interface {
-	Next() Endpoint
+	// Next returns the endpoint to send the next request to, or
+	// ErrNoEndpoints if the service has no endpoints.
+	Next() (Endpoint, error)
+
 	RefreshEndpoints()
+
+	// Close stops refreshing endpoints.
+	Close() error
 }
 
-type RoundRobinLoadBalancer struct {
+// An endpointRefresher refreshes a service's endpoints from Service
+// Directory in the background until it is closed, passing each new
+// list to update. It is embedded by the load balancers in this package.
+type endpointRefresher struct {
+	env       *Environment
 	name      string
 	namespace string
+	filter    string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	update func([]Endpoint)
+
+	mu        sync.Mutex
 	endpoints []Endpoint
-	current   int
+	exclude   func(Endpoint) bool
+	retain    func([]Endpoint)
+	prefer    map[string]string
 }
 
-func NewRoundRobinLoadBalancer(name, namespace string) (*RoundRobinLoadBalancer, error) {
-	endpoints, err := Endpoints(name, namespace)
+// newEndpointRefresher fetches the current endpoints matching filter,
+// passes them to update, and returns a refresher bound to ctx. The
+// caller starts RefreshEndpoints.
+func newEndpointRefresher(ctx context.Context, env *Environment, name, namespace, filter string, update func([]Endpoint)) (*endpointRefresher, error) {
+	endpoints, err := env.FilterEndpoints(ctx, name, namespace, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	loadBalancer := &RoundRobinLoadBalancer{name, namespace, endpoints, 0}
+	ctx, cancel := context.WithCancel(ctx)
 
-	go loadBalancer.RefreshEndpoints()
+	r := &endpointRefresher{
+		env:       env,
+		name:      name,
+		namespace: namespace,
+		filter:    filter,
+		ctx:       ctx,
+		cancel:    cancel,
+		update:    update,
+	}
+	r.setEndpoints(endpoints)
 
-	return loadBalancer, nil
+	return r, nil
 }
 
-func (lb *RoundRobinLoadBalancer) Next() Endpoint {
-	endpoint := lb.endpoints[lb.current]
-	lb.current++
-
-	if lb.current >= len(lb.endpoints) {
-		lb.current = 0
-	}
-	return endpoint
-}
+// RefreshEndpoints refreshes the endpoints every 10 seconds until the
+// load balancer is closed.
+func (r *endpointRefresher) RefreshEndpoints() {
+	ticker := time.NewTicker(endpointRefreshInterval)
+	defer ticker.Stop()
 
-func (lb *RoundRobinLoadBalancer) RefreshEndpoints() {
 	for {
-		time.Sleep(time.Second * 10)
-		endpoints, err := Endpoints(lb.name, lb.namespace)
-		if err != nil {
-			Log("Error", err.Error())
-			continue
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return
+		}
+
+		if err := r.refresh(); err != nil && r.ctx.Err() == nil {
+			r.env.log("Error", err.Error())
 		}
-		lb.endpoints = endpoints
-		lb.current = 0
 	}
 }
 
-func Endpoints(name, namespace string) ([]Endpoint, error) {
-	var listEndpoints ListEndpoints
+// Close stops refreshing endpoints. The load balancer continues to
+// return the last known endpoints.
+func (r *endpointRefresher) Close() error {
+	r.cancel()
+	return nil
+}
 
-	scopes := []string{"https://www.googleapis.com/auth/cloud-platform"}
-	token, err := Token(scopes)
+// refresh replaces the endpoints with the current list from Service
+// Directory.
+func (r *endpointRefresher) refresh() error {
+	endpoints, err := r.env.FilterEndpoints(r.ctx, r.name, r.namespace, r.filter)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	basePath, err := formatEndpointBasePath(name, namespace)
-	if err != nil {
-		return nil, err
+	r.setEndpoints(endpoints)
+	return nil
+}
+
+func (r *endpointRefresher) setEndpoints(endpoints []Endpoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.endpoints = endpoints
+	if r.retain != nil {
+		r.retain(endpoints)
 	}
+	r.apply()
+}
+
+// setExclude sets a function reporting endpoints that must not receive
+// requests, such as endpoints ejected by outlier detection.
+func (r *endpointRefresher) setExclude(exclude func(Endpoint) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	url := fmt.Sprintf("%s/v1/%s", serviceDirectoryEndpoint, basePath)
+	r.exclude = exclude
+	r.apply()
+}
 
-	c := http.Client{
-		Timeout: time.Second * 10,
+// setRetain sets a function that is passed each new list of endpoints,
+// so that state kept for endpoints no longer listed can be discarded.
+func (r *endpointRefresher) setRetain(retain func([]Endpoint)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.retain = retain
+}
+
+// setPrefer sets annotations that endpoints are preferred to have.
+func (r *endpointRefresher) setPrefer(prefer map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prefer = prefer
+	r.apply()
+}
+
+// reapply passes the endpoints to update again after the result of
+// exclude has changed.
+func (r *endpointRefresher) reapply() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.apply()
+}
+
+// apply passes the endpoints not excluded to update, narrowed to those
+// with the preferred annotations if there are any. If every endpoint
+// is excluded, all of them are used rather than failing every request.
+// r.mu must be held.
+func (r *endpointRefresher) apply() {
+	endpoints := r.endpoints
+
+	if r.exclude != nil {
+		var included []Endpoint
+		for _, endpoint := range endpoints {
+			if !r.exclude(endpoint) {
+				included = append(included, endpoint)
+			}
+		}
+
+		if len(included) > 0 {
+			endpoints = included
+		}
 	}
 
-	request, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
+	if len(r.prefer) > 0 {
+		var preferred []Endpoint
+		for _, endpoint := range endpoints {
+			if hasAnnotations(endpoint, r.prefer) {
+				preferred = append(preferred, endpoint)
+			}
+		}
+
+		if len(preferred) > 0 {
+			endpoints = preferred
+		}
 	}
 
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+	r.update(endpoints)
+}
 
-	response, err := c.Do(request)
-	if err != nil {
-		return nil, err
+// hasAnnotations reports whether endpoint has all the given annotation
+// values.
+func hasAnnotations(endpoint Endpoint, annotations map[string]string) bool {
+	for k, v := range annotations {
+		if endpoint.Annotations[k] != v {
+			return false
+		}
 	}
+	return true
+}
+
+// RoundRobinLoadBalancer distributes requests evenly across the
+// endpoints of a Service Directory service. It is safe for concurrent
+// use.
+//
+// Endpoints are refreshed in the background until Close is called or
+// the context the load balancer was created with is done.
+type RoundRobinLoadBalancer struct {
+	*endpointRefresher
 
-	data, err := io.ReadAll(response.Body)
+	mu        sync.Mutex
+	endpoints []Endpoint
+	current   int
+}
+
+func NewRoundRobinLoadBalancer(name, namespace string) (*RoundRobinLoadBalancer, error) {
+	return newRoundRobinLoadBalancer(context.Background(), DefaultEnvironment, name, namespace, "")
+}
+
+// NewRoundRobinLoadBalancerContext is like NewRoundRobinLoadBalancer
+// but stops refreshing endpoints when ctx is done.
+func NewRoundRobinLoadBalancerContext(ctx context.Context, name, namespace string) (*RoundRobinLoadBalancer, error) {
+	return newRoundRobinLoadBalancer(ctx, DefaultEnvironment, name, namespace, "")
+}
+
+func newRoundRobinLoadBalancer(ctx context.Context, env *Environment, name, namespace, filter string) (*RoundRobinLoadBalancer, error) {
+	loadBalancer := &RoundRobinLoadBalancer{}
+
+	refresher, err := newEndpointRefresher(ctx, env, name, namespace, filter, loadBalancer.setEndpoints)
 	if err != nil {
 		return nil, err
 	}
+	loadBalancer.endpointRefresher = refresher
 
-	defer response.Body.Close()
+	go loadBalancer.RefreshEndpoints()
+
+	return loadBalancer, nil
+}
+
+func (lb *RoundRobinLoadBalancer) Next() (Endpoint, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
 
-	if response.StatusCode != 200 {
-		Log("Error", string(data))
-		return nil, errors.New(fmt.Sprintf("run: non 200 response when retrieving endpoints: %s", response.Status))
+	if len(lb.endpoints) == 0 {
+		return Endpoint{}, ErrNoEndpoints
 	}
 
-	if err := json.Unmarshal(data, &listEndpoints); err != nil {
-		return nil, err
+	endpoint := lb.endpoints[lb.current]
+	lb.current++
+
+	if lb.current >= len(lb.endpoints) {
+		lb.current = 0
 	}
+	return endpoint, nil
+}
+
+func (lb *RoundRobinLoadBalancer) setEndpoints(endpoints []Endpoint) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	lb.endpoints = endpoints
+	lb.current = 0
+}
+
+func Endpoints(name, namespace string) ([]Endpoint, error) {
+	return DefaultEnvironment.Endpoints(context.Background(), name, namespace)
+}
+
+// EndpointsContext is like Endpoints but uses the given context.
+func EndpointsContext(ctx context.Context, name, namespace string) ([]Endpoint, error) {
+	return DefaultEnvironment.Endpoints(ctx, name, namespace)
+}
+
+// Endpoints returns the Service Directory endpoints registered for the
+// named service in the given namespace.
+func (e *Environment) Endpoints(ctx context.Context, name, namespace string) ([]Endpoint, error) {
+	return e.FilterEndpoints(ctx, name, namespace, "")
+}
 
-	return listEndpoints.Endpoints, nil
+// FilterEndpoints returns the Service Directory endpoints registered for
+// the named service in the given namespace that match filter, a
+// Service Directory filter expression such as
+// `annotations.version="v2"`. An empty filter matches every endpoint.
+func FilterEndpoints(name, namespace, filter string) ([]Endpoint, error) {
+	return DefaultEnvironment.FilterEndpoints(context.Background(), name, namespace, filter)
 }
 
-func RegisterEndpoint(namespace string) error {
+// FilterEndpointsContext is like FilterEndpoints but uses the given
+// context.
+func FilterEndpointsContext(ctx context.Context, name, namespace, filter string) ([]Endpoint, error) {
+	return DefaultEnvironment.FilterEndpoints(ctx, name, namespace, filter)
+}
+
+// FilterEndpoints returns the Service Directory endpoints registered for
+// the named service in the given namespace that match filter. All
+// pages of results are returned. ErrServiceNotFound is returned if the
+// service does not exist.
+func (e *Environment) FilterEndpoints(ctx context.Context, name, namespace, filter string) ([]Endpoint, error) {
+	ctx, cancel := e.withAPITimeout(ctx)
+	defer cancel()
+
 	scopes := []string{"https://www.googleapis.com/auth/cloud-platform"}
-	token, err := Token(scopes)
+	token, err := e.Token(ctx, scopes)
 	if err != nil {
-		Log("Error", fmt.Sprintf("Unable to register endpoint: %s", err))
-		return err
-	}
-
-	c := http.Client{
-		Timeout: time.Second * 10,
+		return nil, err
 	}
 
-	basePath, err := formatEndpointBasePath("", namespace)
+	basePath, err := e.formatEndpointBasePath(ctx, name, namespace)
 	if err != nil {
-		Log("Error", fmt.Sprintf("Unable to register endpoint. Error formating endpoint base path: %s", err))
-		return err
+		return nil, err
 	}
 
-	endpointID, err := generateEndpointID()
-	if err != nil {
-		Log("Error", fmt.Sprintf("Unable to register endpoint. Error generating endpoint ID: %s", err))
-		return err
+	var endpoints []Endpoint
+	var pageToken string
+	for {
+		query := make(url.Values)
+		if filter != "" {
+			query.Set("filter", filter)
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		u := fmt.Sprintf("%s/v1/%s", e.ServiceDirectoryEndpoint, basePath)
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+
+		response, err := e.httpClient().Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if response.StatusCode == http.StatusNotFound {
+			return nil, ErrServiceNotFound
+		}
+		if response.StatusCode != 200 {
+			e.log("Error", string(data))
+			return nil, errors.New(fmt.Sprintf("run: non 200 response when retrieving endpoints: %s", response.Status))
+		}
+
+		var listEndpoints ListEndpoints
+		if err := json.Unmarshal(data, &listEndpoints); err != nil {
+			return nil, err
+		}
+
+		endpoints = append(endpoints, listEndpoints.Endpoints...)
+
+		if listEndpoints.NextPageToken == "" {
+			return endpoints, nil
+		}
+		pageToken = listEndpoints.NextPageToken
 	}
+}
 
-	url := fmt.Sprintf("%s/v1/%s?endpointId=%s", serviceDirectoryEndpoint, basePath, endpointID)
+// Annotations set on the running instance's endpoint by RegisterEndpoint.
+const (
+	InstanceIDAnnotation    = "instance_id"
+	RevisionAnnotation      = "revision"
+	ConfigurationAnnotation = "configuration"
+
+	// ZoneAnnotation holds the zone the instance is running in, for
+	// zone-local routing with LoadBalancingPolicy.Prefer. It is omitted
+	// if the zone cannot be determined.
+	ZoneAnnotation = "zone"
+
+	// HeartbeatAnnotation holds the time, in RFC 3339 format, the
+	// endpoint was last refreshed by a Registration, which keeps it
+	// current while the server runs. Endpoints registered directly with
+	// RegisterEndpoint have no heartbeat. See PruneStaleEndpoints.
+	HeartbeatAnnotation = "heartbeat"
+)
 
-	ip, err := IPAddress()
-	if err != nil {
-		Log("Error", fmt.Sprintf("Unable to register endpoint. Error getting IP address: %s", err))
-		return err
+// A RegisterAction describes how RegisterEndpoint registered the
+// running instance.
+type RegisterAction int
+
+const (
+	// EndpointCreated means a new endpoint was created.
+	EndpointCreated RegisterAction = iota + 1
+
+	// EndpointUpdated means an endpoint with the same ID already
+	// existed and was updated in place.
+	EndpointUpdated
+)
+
+func (a RegisterAction) String() string {
+	switch a {
+	case EndpointCreated:
+		return "created"
+	case EndpointUpdated:
+		return "updated"
+	default:
+		return "unknown"
 	}
+}
 
-	port, err := strconv.Atoi(Port())
+// RegisterResult is the result of registering the running instance.
+type RegisterResult struct {
+	Action   RegisterAction
+	Endpoint *Endpoint
+}
+
+// RegisterEndpoint registers the running instance as an endpoint of
+// the current Cloud Run service in the given Service Directory
+// namespace.
+func RegisterEndpoint(namespace string) (*RegisterResult, error) {
+	return DefaultEnvironment.RegisterEndpoint(context.Background(), namespace)
+}
+
+// RegisterEndpointContext is like RegisterEndpoint but uses the given
+// context.
+func RegisterEndpointContext(ctx context.Context, namespace string) (*RegisterResult, error) {
+	return DefaultEnvironment.RegisterEndpoint(ctx, namespace)
+}
+
+// RegisterEndpoint registers the running instance as an endpoint of
+// the current Cloud Run service in the given Service Directory
+// namespace.
+//
+// The endpoint ID is derived from the service name and instance IP
+// address. If an endpoint with that ID already exists, for example
+// after a restart on the same IP address, its address, port, and
+// annotations are updated instead.
+//
+// The endpoint has no heartbeat annotation, so PruneStaleEndpoints
+// leaves it alone. Use WithRegistration to keep a heartbeat current.
+func (e *Environment) RegisterEndpoint(ctx context.Context, namespace string) (*RegisterResult, error) {
+	return e.registerEndpoint(ctx, namespace, false)
+}
+
+// registerEndpoint registers the running instance, with a heartbeat
+// annotation set to the current time if heartbeat is true.
+func (e *Environment) registerEndpoint(ctx context.Context, namespace string, heartbeat bool) (*RegisterResult, error) {
+	endpointID, err := generateEndpointID()
 	if err != nil {
-		Log("Error", fmt.Sprintf("Unable to register endpoint. Error converting instance port: %s", err))
-		return err
+		e.log("Error", fmt.Sprintf("Unable to register endpoint. Error generating endpoint ID: %s", err))
+		return nil, err
 	}
 
-	instanceID, err := ID()
+	ep, err := e.instanceEndpoint(ctx)
 	if err != nil {
-		Log("Error", fmt.Sprintf("Unable to register endpoint. Error retrieving instance ID: %s", err))
-		return err
+		e.log("Error", fmt.Sprintf("Unable to register endpoint: %s", err))
+		return nil, err
+	}
+	if heartbeat {
+		ep.Annotations[HeartbeatAnnotation] = time.Now().UTC().Format(time.RFC3339)
 	}
 
-	annotations := make(map[string]string)
-	annotations["instance_id"] = instanceID
+	service := ServiceName()
 
-	ep := Endpoint{
-		Address:     ip,
-		Port:        port,
-		Annotations: annotations,
+	created, err := e.CreateEndpoint(ctx, namespace, service, endpointID, ep)
+	if err == nil {
+		e.log("Info", fmt.Sprintf("Successfully registered endpoint: %s", endpointID))
+		return &RegisterResult{EndpointCreated, created}, nil
+	}
+	if err != ErrAlreadyExists {
+		e.log("Error", fmt.Sprintf("Unable to register endpoint: %s", err))
+		return nil, err
 	}
 
-	data, err := json.Marshal(ep)
+	updated, err := e.UpdateEndpoint(ctx, namespace, service, endpointID, ep, "address", "port", "annotations")
 	if err != nil {
-		Log("Error", fmt.Sprintf("Unable to register endpoint. Error serializing endpoint request object: %s", err))
-		return err
+		e.log("Error", fmt.Sprintf("Unable to update registered endpoint: %s", err))
+		return nil, err
 	}
 
-	body := bytes.NewBuffer(data)
+	return &RegisterResult{EndpointUpdated, updated}, nil
+}
 
-	request, err := http.NewRequest(http.MethodPost, url, body)
+// instanceEndpoint returns the endpoint describing the running
+// instance.
+func (e *Environment) instanceEndpoint(ctx context.Context) (Endpoint, error) {
+	ip, err := instanceIPAddress()
 	if err != nil {
-		Log("Error", fmt.Sprintf("Unable to register endpoint. Error create endpoint HTTP request: %s", err))
-		return err
+		return Endpoint{}, fmt.Errorf("error getting IP address: %w", err)
 	}
 
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+	port, err := strconv.Atoi(Port())
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("error converting instance port: %w", err)
+	}
 
-	response, err := c.Do(request)
+	instanceID, err := e.ID(ctx)
 	if err != nil {
-		Log("Error", fmt.Sprintf("Unable to register endpoint. HTTP request failed: %s", err))
-		return err
+		return Endpoint{}, fmt.Errorf("error retrieving instance ID: %w", err)
 	}
 
-	if response.StatusCode != 200 {
-		data, err := io.ReadAll(response.Body)
-		if err != nil {
-			Log("Error", fmt.Sprintf("Unable to register endpoint. Error reading HTTP response: %s", err))
-			return err
-		}
+	annotations := map[string]string{
+		InstanceIDAnnotation: instanceID,
+	}
+	if zone, err := e.Zone(ctx); err == nil {
+		annotations[ZoneAnnotation] = zone
+	}
+	if revision := Revision(); revision != "" {
+		annotations[RevisionAnnotation] = revision
+	}
+	if configuration := Configuration(); configuration != "" {
+		annotations[ConfigurationAnnotation] = configuration
+	}
 
-		Log("Error", fmt.Sprintf("Unable to register endpoint. HTTP request failed: %s", string(data)))
-		return errors.New(fmt.Sprintf("run: non 200 response when registering endpoint: %s", response.Status))
+	ep := Endpoint{
+		Address:     ip,
+		Port:        port,
+		Annotations: annotations,
 	}
 
-	Log("Info", fmt.Sprintf("Successfully registered endpoint: %s", endpointID))
-	return nil
+	return ep, nil
 }
 
+// DeregisterEndpoint removes the running instance's endpoint from the
+// given Service Directory namespace.
 func DeregisterEndpoint(namespace string) error {
-	scopes := []string{"https://www.googleapis.com/auth/cloud-platform"}
-	token, err := Token(scopes)
-	if err != nil {
-		return err
-	}
+	return DefaultEnvironment.DeregisterEndpoint(context.Background(), namespace)
+}
 
-	basePath, err := formatEndpointBasePath("", namespace)
-	if err != nil {
-		return err
-	}
+// DeregisterEndpointContext is like DeregisterEndpoint but uses the
+// given context.
+func DeregisterEndpointContext(ctx context.Context, namespace string) error {
+	return DefaultEnvironment.DeregisterEndpoint(ctx, namespace)
+}
 
+// DeregisterEndpoint removes the running instance's endpoint from the
+// given Service Directory namespace. An endpoint that is already gone,
+// for example one removed by PruneStaleEndpoints, is not an error.
+func (e *Environment) DeregisterEndpoint(ctx context.Context, namespace string) error {
 	endpointID, err := generateEndpointID()
 	if err != nil {
 		return err
 	}
 
-	url := fmt.Sprintf("%s/v1/%s/%s", serviceDirectoryEndpoint, basePath, endpointID)
-
-	c := http.Client{
-		Timeout: time.Second * 10,
+	err = e.DeleteEndpoint(ctx, namespace, ServiceName(), endpointID)
+	if err == ErrEndpointNotFound {
+		return nil
 	}
+	return err
+}
 
-	request, err := http.NewRequest(http.MethodDelete, url, nil)
-	if err != nil {
-		return err
-	}
+// PruneStaleEndpoints deletes endpoints of a Service Directory service
+// whose heartbeat is older than maxAge, and returns the deleted
+// endpoints. Endpoints without a heartbeat annotation, such as those
+// registered directly with RegisterEndpoint, are left alone.
+func PruneStaleEndpoints(namespace, service string, maxAge time.Duration) ([]Endpoint, error) {
+	return DefaultEnvironment.PruneStaleEndpoints(context.Background(), namespace, service, maxAge)
+}
 
-	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+// PruneStaleEndpointsContext is like PruneStaleEndpoints but uses the
+// given context.
+func PruneStaleEndpointsContext(ctx context.Context, namespace, service string, maxAge time.Duration) ([]Endpoint, error) {
+	return DefaultEnvironment.PruneStaleEndpoints(ctx, namespace, service, maxAge)
+}
 
-	response, err := c.Do(request)
+// PruneStaleEndpoints deletes endpoints of a Service Directory service
+// whose heartbeat is older than maxAge, and returns the deleted
+// endpoints.
+//
+// Instances registered by ListenAndServe with WithRegistration refresh
+// their heartbeat every Registration interval, so maxAge should be
+// several times that interval.
+func (e *Environment) PruneStaleEndpoints(ctx context.Context, namespace, service string, maxAge time.Duration) ([]Endpoint, error) {
+	endpoints, err := e.Endpoints(ctx, service, namespace)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if response.StatusCode != 200 {
-		data, err := io.ReadAll(response.Body)
+	deadline := time.Now().Add(-maxAge)
+
+	var pruned []Endpoint
+	for _, endpoint := range endpoints {
+		heartbeat, ok := endpoint.Annotations[HeartbeatAnnotation]
+		if !ok {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, heartbeat)
+		if err != nil || t.After(deadline) {
+			continue
+		}
+
+		endpointID := path.Base(endpoint.Name)
+		err = e.DeleteEndpoint(ctx, namespace, service, endpointID)
+		if err == ErrEndpointNotFound {
+			// Already deleted by another instance.
+			continue
+		}
 		if err != nil {
-			return err
+			return pruned, err
 		}
 
-		Log("Error", string(data))
-		return errors.New(fmt.Sprintf("run: non 200 response when deregistering endpoint: %s", response.Status))
+		e.log("Info", fmt.Sprintf("Pruned stale endpoint: %s", endpointID))
+		pruned = append(pruned, endpoint)
 	}
 
-	return nil
+	return pruned, nil
 }
 
-func formatEndpointBasePath(name, namespace string) (string, error) {
+func (e *Environment) formatEndpointBasePath(ctx context.Context, name, namespace string) (string, error) {
 	if name == "" {
 		name = ServiceName()
 	}
-	region, err := Region()
+	region, err := e.Region(ctx)
 	if err != nil {
 		return "", err
 	}
 
-	projectID, err := ProjectID()
+	projectID, err := e.ProjectID(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -285,10 +655,14 @@ func formatEndpointBasePath(name, namespace string) (string, error) {
 	return s, nil
 }
 
+// instanceIPAddress returns the IP address registered for the running
+// instance. It is a variable so tests can replace it.
+var instanceIPAddress = func() (string, error) { return IPAddress() }
+
 func generateEndpointID() (string, error) {
 	serviceName := ServiceName()
 
-	ip, err := IPAddress()
+	ip, err := instanceIPAddress()
 	if err != nil {
 		return "", err
 	}
@@ -1,10 +1,13 @@
 package run
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kelseyhightower/run/internal/gcptest"
 )
@@ -26,12 +29,12 @@ func TestEndpoints(t *testing.T) {
 	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
 	defer ms.Close()
 
-	metadataEndpoint = ms.URL
+	DefaultEnvironment.MetadataEndpoint = ms.URL
 
 	ss := httptest.NewServer(http.HandlerFunc(gcptest.ServiceDirectoryHandler))
 	defer ss.Close()
 
-	serviceDirectoryEndpoint = ss.URL
+	DefaultEnvironment.ServiceDirectoryEndpoint = ss.URL
 
 	endpoints, err := Endpoints("test", "test")
 	if err != nil {
@@ -57,12 +60,12 @@ func TestNewRoundRobinLoadBalancer(t *testing.T) {
 	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
 	defer ms.Close()
 
-	metadataEndpoint = ms.URL
+	DefaultEnvironment.MetadataEndpoint = ms.URL
 
 	ss := httptest.NewServer(http.HandlerFunc(gcptest.ServiceDirectoryHandler))
 	defer ss.Close()
 
-	serviceDirectoryEndpoint = ss.URL
+	DefaultEnvironment.ServiceDirectoryEndpoint = ss.URL
 
 	for _, tt := range newRoundRobinLoadBalancerTests {
 		lb, err := NewRoundRobinLoadBalancer(tt.namespace, tt.name)
@@ -71,10 +74,317 @@ func TestNewRoundRobinLoadBalancer(t *testing.T) {
 		}
 
 		for i := 0; i <= len(tt.want)-1; i++ {
-			endpoint := lb.Next()
+			endpoint, err := lb.Next()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 			if !reflect.DeepEqual(endpoint, tt.want[i]) {
 				t.Errorf("want %v, got %v", tt.want[i], endpoint)
 			}
 		}
 	}
 }
+
+func TestRoundRobinLoadBalancerConcurrentRefresh(t *testing.T) {
+	e := serviceDirectoryEnvironment(t, http.HandlerFunc(gcptest.ServiceDirectoryHandler))
+
+	lb, err := newRoundRobinLoadBalancer(context.Background(), e, "test", "test", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := lb.Next(); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := lb.refresh(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRoundRobinLoadBalancerClose(t *testing.T) {
+	e := serviceDirectoryEnvironment(t, http.HandlerFunc(gcptest.ServiceDirectoryHandler))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lb, err := newRoundRobinLoadBalancer(ctx, e, "test", "test", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := lb.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case <-lb.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("load balancer not stopped after Close")
+	}
+
+	if endpoint, _ := lb.Next(); !reflect.DeepEqual(endpoint, testEndpoints[0]) {
+		t.Errorf("endpoint mismatch after Close; want %v, got %v", testEndpoints[0], endpoint)
+	}
+}
+
+func TestRoundRobinLoadBalancerContext(t *testing.T) {
+	e := serviceDirectoryEnvironment(t, http.HandlerFunc(gcptest.ServiceDirectoryHandler))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	lb, err := newRoundRobinLoadBalancer(ctx, e, "test", "test", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cancel()
+
+	select {
+	case <-lb.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("load balancer not stopped after context cancellation")
+	}
+}
+
+func TestRoundRobinLoadBalancerNoEndpoints(t *testing.T) {
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "empty", nil)
+
+	e := serviceDirectoryEnvironment(t, sd)
+
+	lb, err := newRoundRobinLoadBalancer(context.Background(), e, "empty", "test", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lb.Close()
+
+	if _, err := lb.Next(); err != ErrNoEndpoints {
+		t.Errorf("error mismatch; want %v, got %v", ErrNoEndpoints, err)
+	}
+}
+
+var annotatedEndpoints = []gcptest.Endpoint{
+	{Name: "test-10-0-0-1", Address: "10.0.0.1", Port: 8080, Annotations: map[string]string{"version": "v1", "zone": "test-1"}},
+	{Name: "test-10-0-0-2", Address: "10.0.0.2", Port: 8080, Annotations: map[string]string{"version": "v1", "zone": "test-2"}},
+	{Name: "test-10-0-0-3", Address: "10.0.0.3", Port: 8080, Annotations: map[string]string{"version": "v2", "zone": "test-1"}},
+}
+
+func TestFilterEndpoints(t *testing.T) {
+	sd := gcptest.NewServiceDirectory()
+	sd.PageSize = 1
+	sd.SetEndpoints("test", "test", annotatedEndpoints)
+
+	e := serviceDirectoryEnvironment(t, sd)
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"", []string{"test-10-0-0-1", "test-10-0-0-2", "test-10-0-0-3"}},
+		{`annotations.version="v1"`, []string{"test-10-0-0-1", "test-10-0-0-2"}},
+		{`annotations.version="v1" AND annotations.zone="test-1"`, []string{"test-10-0-0-1"}},
+		{`annotations.version="v3"`, nil},
+	}
+
+	for _, tt := range tests {
+		endpoints, err := e.FilterEndpoints(context.Background(), "test", "test", tt.filter)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.filter, err)
+			continue
+		}
+
+		var got []string
+		for _, endpoint := range endpoints {
+			got = append(got, endpoint.Name)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: endpoints mismatch; want %v, got %v", tt.filter, tt.want, got)
+		}
+	}
+}
+
+func TestRoundRobinLoadBalancerPrefer(t *testing.T) {
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "test", annotatedEndpoints)
+
+	e := serviceDirectoryEnvironment(t, sd)
+
+	lb, err := newRoundRobinLoadBalancer(context.Background(), e, "test", "test", `annotations.version="v1"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer lb.Close()
+
+	lb.setPrefer(map[string]string{"zone": "test-1"})
+	for i := 0; i < 3; i++ {
+		endpoint, err := lb.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if endpoint.Name != "test-10-0-0-1" {
+			t.Errorf("endpoint mismatch; want test-10-0-0-1, got %s", endpoint.Name)
+		}
+	}
+
+	// With no preferred endpoint every filtered endpoint is used.
+	lb.setPrefer(map[string]string{"zone": "test-3"})
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		endpoint, err := lb.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		seen[endpoint.Name] = true
+	}
+	if len(seen) != 2 || seen["test-10-0-0-3"] {
+		t.Errorf("endpoints mismatch; want test-10-0-0-1 and test-10-0-0-2, got %v", seen)
+	}
+}
+
+func TestRegisterEndpoint(t *testing.T) {
+	e, sd := registrationEnvironment(t)
+	ctx := context.Background()
+
+	t.Setenv("K_REVISION", "registered-00001")
+	t.Setenv("K_CONFIGURATION", "registered")
+
+	result, err := e.RegisterEndpoint(ctx, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Action != EndpointCreated {
+		t.Errorf("action mismatch; want %s, got %s", EndpointCreated, result.Action)
+	}
+
+	// A restart on the same IP address registers a new revision.
+	t.Setenv("K_REVISION", "registered-00002")
+	t.Setenv("PORT", "9090")
+
+	result, err = e.RegisterEndpoint(ctx, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Action != EndpointUpdated {
+		t.Errorf("action mismatch; want %s, got %s", EndpointUpdated, result.Action)
+	}
+
+	endpoints := sd.Endpoints("test", "registered")
+	if len(endpoints) != 1 {
+		t.Fatalf("endpoint count mismatch; want 1, got %d", len(endpoints))
+	}
+
+	endpoint := endpoints[0]
+	if endpoint.Port != 9090 {
+		t.Errorf("port mismatch; want 9090, got %d", endpoint.Port)
+	}
+	if revision := endpoint.Annotations[RevisionAnnotation]; revision != "registered-00002" {
+		t.Errorf("revision mismatch; want registered-00002, got %s", revision)
+	}
+	if configuration := endpoint.Annotations[ConfigurationAnnotation]; configuration != "registered" {
+		t.Errorf("configuration mismatch; want registered, got %s", configuration)
+	}
+	if endpoint.Annotations[InstanceIDAnnotation] == "" {
+		t.Error("expected instance id annotation")
+	}
+	if zone := endpoint.Annotations[ZoneAnnotation]; zone != gcptest.Zone {
+		t.Errorf("zone mismatch; want %s, got %s", gcptest.Zone, zone)
+	}
+	if _, ok := endpoint.Annotations[HeartbeatAnnotation]; ok {
+		t.Error("unexpected heartbeat annotation without a registration")
+	}
+}
+
+func TestRegisterEndpointWithoutZone(t *testing.T) {
+	e, sd := registrationEnvironment(t)
+
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/computeMetadata/v1/instance/zone" {
+			http.NotFound(w, r)
+			return
+		}
+		gcptest.MetadataHandler(w, r)
+	}))
+	defer ms.Close()
+
+	e.MetadataEndpoint = ms.URL
+
+	if _, err := e.RegisterEndpoint(context.Background(), "test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	endpoints := sd.Endpoints("test", "registered")
+	if len(endpoints) != 1 {
+		t.Fatalf("endpoint count mismatch; want 1, got %d", len(endpoints))
+	}
+	if zone, ok := endpoints[0].Annotations[ZoneAnnotation]; ok {
+		t.Errorf("unexpected zone annotation %q", zone)
+	}
+}
+
+func TestDeregisterEndpoint(t *testing.T) {
+	e, sd := registrationEnvironment(t)
+	ctx := context.Background()
+
+	if _, err := e.RegisterEndpoint(ctx, "test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := e.DeregisterEndpoint(ctx, "test"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := len(sd.Endpoints("test", "registered")); n != 0 {
+		t.Errorf("endpoint count mismatch; want 0, got %d", n)
+	}
+
+	// An endpoint that is already gone is not an error.
+	if err := e.DeregisterEndpoint(ctx, "test"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPruneStaleEndpoints(t *testing.T) {
+	now := time.Now().UTC()
+	stale := now.Add(-time.Hour).Format(time.RFC3339)
+	fresh := now.Format(time.RFC3339)
+
+	e := balancerEnvironment(t, []gcptest.Endpoint{
+		{Name: "test-10-0-0-1", Address: "10.0.0.1", Port: 8080, Annotations: map[string]string{HeartbeatAnnotation: stale}},
+		{Name: "test-10-0-0-2", Address: "10.0.0.2", Port: 8080, Annotations: map[string]string{HeartbeatAnnotation: fresh}},
+		{Name: "test-10-0-0-3", Address: "10.0.0.3", Port: 8080},
+	})
+
+	pruned, err := e.PruneStaleEndpoints(context.Background(), "test", "test", 10*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pruned) != 1 || pruned[0].Address != "10.0.0.1" {
+		t.Errorf("pruned endpoints mismatch; got %+v", pruned)
+	}
+
+	endpoints, err := e.Endpoints(context.Background(), "test", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var addresses []string
+	for _, endpoint := range endpoints {
+		addresses = append(addresses, endpoint.Address)
+	}
+	if want := []string{"10.0.0.2", "10.0.0.3"}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("remaining endpoints mismatch; want %v, got %v", want, addresses)
+	}
+}
@@ -0,0 +1,186 @@
+package run
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMetadataTimeout    = 5 * time.Second
+	defaultAPITimeout         = 10 * time.Second
+	defaultMetadataRetries    = 3
+	defaultMetadataBackoff    = 100 * time.Millisecond
+	defaultMetadataMaxBackoff = 2 * time.Second
+)
+
+// DefaultEnvironment is the Environment used by the package-level
+// functions such as ProjectID, Token, and AccessSecret.
+var DefaultEnvironment = NewEnvironment()
+
+// An Environment holds the endpoints, HTTP client, and logger used to
+// talk to the metadata server and Google Cloud APIs.
+//
+// Each Environment caches its own runtime metadata and tokens, so
+// multiple Environments can be used side by side. Environments should
+// be created with NewEnvironment and must not be modified after first
+// use. Methods on Environment are safe for concurrent use.
+type Environment struct {
+	// MetadataEndpoint is the base URL of the metadata server.
+	MetadataEndpoint string
+
+	// SecretManagerEndpoint is the base URL of the Secret Manager API.
+	SecretManagerEndpoint string
+
+	// ServiceDirectoryEndpoint is the base URL of the Service Directory
+	// API.
+	ServiceDirectoryEndpoint string
+
+	// CloudRunEndpoint is the base URL of the regional Cloud Run API.
+	// The %s verb is replaced with the region.
+	CloudRunEndpoint string
+
+	// IAMCredentialsEndpoint is the base URL of the IAM Service Account
+	// Credentials API.
+	IAMCredentialsEndpoint string
+
+	// HTTPClient is used to make all requests. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// MetadataTimeout bounds each attempt to call the metadata server.
+	MetadataTimeout time.Duration
+
+	// MetadataRetries is the maximum number of times a metadata server
+	// request is retried after a transient error such as a refused
+	// connection, a timeout, or an HTTP 429 or 5xx response. Zero
+	// disables retries.
+	MetadataRetries int
+
+	// MetadataBackoff is the initial delay between metadata server
+	// retries. The delay doubles after each attempt, up to two
+	// seconds, and is randomly jittered.
+	MetadataBackoff time.Duration
+
+	// APITimeout bounds each call to a Google Cloud API.
+	APITimeout time.Duration
+
+	// FallbackSources supply the project ID, region, and default
+	// service account tokens, in order, when the metadata server is
+	// unreachable.
+	FallbackSources []MetadataSource
+
+	// Logger receives errors and notices. If nil, the default logger
+	// is used.
+	Logger *Logger
+
+	mu               sync.Mutex
+	id               string
+	projectID        string
+	numericProjectID string
+	region           string
+	zone             string
+
+	tokensOnce   sync.Once
+	accessTokens *tokenCache
+
+	impersonatedOnce   sync.Once
+	impersonatedTokens *tokenCache
+
+	sourcesMu        sync.Mutex
+	sources          map[string]string
+	unreachableUntil time.Time
+}
+
+// NewEnvironment returns an Environment configured for the Cloud Run
+// container runtime.
+func NewEnvironment() *Environment {
+	e := &Environment{
+		MetadataEndpoint:         "http://metadata.google.internal",
+		SecretManagerEndpoint:    "https://secretmanager.googleapis.com/v1",
+		ServiceDirectoryEndpoint: "https://servicedirectory.googleapis.com",
+		CloudRunEndpoint:         "https://%s-run.googleapis.com",
+		IAMCredentialsEndpoint:   "https://iamcredentials.googleapis.com",
+		MetadataTimeout:          defaultMetadataTimeout,
+		MetadataRetries:          defaultMetadataRetries,
+		MetadataBackoff:          defaultMetadataBackoff,
+		APITimeout:               defaultAPITimeout,
+	}
+	e.FallbackSources = []MetadataSource{EnvSource{}, &ADCSource{defaultClient: e.httpClient}}
+
+	return e
+}
+
+func (e *Environment) httpClient() *http.Client {
+	if e.HTTPClient != nil {
+		return e.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (e *Environment) logger() *Logger {
+	if e.Logger != nil {
+		return e.Logger
+	}
+	return dl
+}
+
+// log writes a log entry using the environment's logger.
+func (e *Environment) log(severity, s string) {
+	e.logger().Log(severity, s)
+}
+
+// metadataTimeout returns the timeout for each metadata server
+// request attempt.
+func (e *Environment) metadataTimeout() time.Duration {
+	if e.MetadataTimeout <= 0 {
+		return defaultMetadataTimeout
+	}
+	return e.MetadataTimeout
+}
+
+// metadataBackoff returns how long to wait before retrying a metadata
+// server request that failed on the given attempt.
+func (e *Environment) metadataBackoff(attempt int) time.Duration {
+	backoff := e.MetadataBackoff
+	if backoff <= 0 {
+		backoff = defaultMetadataBackoff
+	}
+
+	for i := 0; i < attempt && backoff < defaultMetadataMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > defaultMetadataMaxBackoff {
+		backoff = defaultMetadataMaxBackoff
+	}
+
+	// Wait somewhere between half and all of the backoff so that
+	// instances starting together do not retry in lockstep.
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// withAPITimeout returns a copy of ctx bounded by the API timeout.
+func (e *Environment) withAPITimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := e.APITimeout
+	if timeout <= 0 {
+		timeout = defaultAPITimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (e *Environment) tokenCache() *tokenCache {
+	e.tokensOnce.Do(func() {
+		e.accessTokens = newTokenCache(accessTokenRefreshAhead, e.fetchToken)
+	})
+	return e.accessTokens
+}
+
+func (e *Environment) impersonatedTokenCache() *tokenCache {
+	e.impersonatedOnce.Do(func() {
+		e.impersonatedTokens = newTokenCache(accessTokenRefreshAhead, e.fetchImpersonatedToken)
+	})
+	return e.impersonatedTokens
+}
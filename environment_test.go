@@ -0,0 +1,105 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+func TestMain(m *testing.M) {
+	// Keep retries against the failing metadata handlers fast.
+	DefaultEnvironment.MetadataBackoff = time.Millisecond
+
+	os.Exit(m.Run())
+}
+
+func TestEnvironmentIsolation(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/computeMetadata/v1/project/project-id" {
+			fmt.Fprint(w, "other")
+			return
+		}
+		gcptest.MetadataHandler(w, r)
+	}))
+	defer other.Close()
+
+	e1 := NewEnvironment()
+	e1.MetadataEndpoint = ms.URL
+
+	e2 := NewEnvironment()
+	e2.MetadataEndpoint = other.URL
+
+	ctx := context.Background()
+
+	p1, err := e1.ProjectID(ctx)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	p2, err := e2.ProjectID(ctx)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if p1 != gcptest.ProjectID {
+		t.Errorf("want %v, got %v", gcptest.ProjectID, p1)
+	}
+
+	if p2 != "other" {
+		t.Errorf("want %v, got %v", "other", p2)
+	}
+}
+
+func TestEnvironmentHTTPClient(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	var requests int
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+	e.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			requests++
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}
+
+	if _, err := e.Region(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if requests != 1 {
+		t.Errorf("request count mismatch; want 1, got %d", requests)
+	}
+}
+
+func TestEnvironmentMetadataTimeout(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		gcptest.MetadataHandler(w, r)
+	}))
+	defer ms.Close()
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+	e.MetadataTimeout = 10 * time.Millisecond
+
+	if _, err := e.ID(context.Background()); err == nil {
+		t.Error("expected timeout error")
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -1,6 +1,7 @@
 package run_test
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -72,6 +73,34 @@ func ExampleToken() {
 	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
 }
 
+func ExampleEnvironment() {
+	env := run.NewEnvironment()
+	env.HTTPClient = &http.Client{}
+	env.Logger = run.NewLogger()
+
+	project, err := env.ProjectID(context.Background())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	client := &http.Client{
+		Transport: &run.Transport{
+			InjectAuthHeader: true,
+			Environment:      env,
+		},
+	}
+
+	response, err := client.Get("http://backend.test.run.local/")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer response.Body.Close()
+
+	log.Printf("Called backend from project %s: %s", project, response.Status)
+}
+
 func ExampleLogger() {
 	logger := run.NewLogger()
 
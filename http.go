@@ -4,13 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
@@ -25,82 +28,575 @@ var Client = &http.Client{
 	Transport: &Transport{
 		Base:             http.DefaultTransport,
 		InjectAuthHeader: true,
-		balancers:        make(map[string]*RoundRobinLoadBalancer),
 	},
 }
 
 // Transport is a http.RoundTripper that attaches ID tokens to all
 // outgoing request.
+//
+// A Transport is safe for concurrent use by multiple goroutines.
 type Transport struct {
 	// Base optionally provides a http.RoundTripper that handles the
 	// request. If nil, http.DefaultTransport is used.
 	Base http.RoundTripper
 
 	// InjectAuthHeader optionally adds or replaces the HTTP Authorization
-	// header using the ID token from the metadata service.
+	// header using the ID token from the metadata service, or an access
+	// token for requests to Google APIs. ID tokens are cached per
+	// audience and refreshed shortly before they expire.
 	InjectAuthHeader bool
 
-	balancers map[string]*RoundRobinLoadBalancer
+	// AccessTokenScopes optionally sets the OAuth scopes of the access
+	// tokens injected instead of ID tokens for requests to Google APIs
+	// (hosts ending in .googleapis.com). If empty, the cloud-platform
+	// scope is used.
+	AccessTokenScopes []string
+
+	// UseAccessTokens optionally injects access tokens for all
+	// requests, for example to call Google APIs through a private
+	// endpoint. Requests with an audience set by WithAudience still
+	// use ID tokens.
+	UseAccessTokens bool
+
+	// PreserveAuthHeader optionally leaves the Authorization header of
+	// requests that already have one untouched when InjectAuthHeader is
+	// set.
+	PreserveAuthHeader bool
+
+	// Environment optionally provides the Environment used to fetch ID
+	// tokens and discover endpoints. If nil, DefaultEnvironment is used.
+	Environment *Environment
+
+	// BalancerIdleTimeout is how long a service's load balancer is kept
+	// after its last request before it is closed and discarded. If zero,
+	// five minutes is used. If negative, load balancers are kept until
+	// the transport is closed.
+	BalancerIdleTimeout time.Duration
+
+	// LoadBalancing optionally selects the load balancing policy for
+	// individual services, keyed by "service.namespace". Services not
+	// listed use round robin.
+	LoadBalancing map[string]LoadBalancingPolicy
+
+	// OutlierDetection optionally ejects endpoints that fail repeatedly
+	// from load balancing. If nil, outlier detection is disabled.
+	OutlierDetection *OutlierDetection
+
+	// Retry optionally retries failed requests to Service Directory
+	// endpoints on other endpoints of the service. If nil, requests are
+	// not retried.
+	Retry *RetryPolicy
+
+	// FallbackToServiceURL optionally sends requests for services that
+	// are not registered in Service Directory, or have no endpoints, to
+	// the service's public Cloud Run URL, with an ID token, instead of
+	// failing with ErrServiceNotFound or ErrNoEndpoints.
+	FallbackToServiceURL bool
+
+	// EnableServiceNameResolution optionally sends requests for hosts
+	// of the form name, name.region, or name.region.project to the URL
+	// of the named Cloud Run service, looked up with the Cloud Run API.
+	// The region and project default to those of the running instance.
+	//
+	// If DefaultNamespace is set, a bare name is a Service Directory
+	// service in that namespace, as it is without name resolution, and
+	// only name.region and name.region.project hosts are resolved.
+	//
+	// Cloud Run services require authentication by default, so these
+	// requests always carry an ID token for the service URL, even if
+	// InjectAuthHeader is false.
+	EnableServiceNameResolution bool
+
+	// ServiceNameTTL is how long resolved service URLs are cached. If
+	// zero, five minutes is used.
+	ServiceNameTTL time.Duration
+
+	// Audiences optionally sets the ID token audience for individual
+	// Service Directory services, keyed by "service.namespace". Other
+	// services use the URL of the logical hostname, such as
+	// "http://service.namespace.run.local", rather than the endpoint
+	// the request is sent to. WithAudience overrides both.
+	Audiences map[string]string
+
+	mu          sync.Mutex
+	balancers   map[string]*balancerEntry
+	creating    map[string]*balancerCall
+	janitorStop chan struct{}
+
+	retries     retryBudget
+	serviceURLs serviceURLCache
+
+	idTokensOnce sync.Once
+	idTokens     *tokenCache
+}
+
+// balancerEntry holds a service's load balancer and outlier detector
+// and tracks when they were last used.
+type balancerEntry struct {
+	lb       LoadBalancer
+	outliers *outlierDetector
+	lastUsed time.Time
+}
+
+// next returns the endpoint for the request.
+func (e *balancerEntry) next(r *http.Request) (Endpoint, error) {
+	if lb, ok := e.lb.(RequestLoadBalancer); ok {
+		return lb.NextRequest(r)
+	}
+	return e.lb.Next()
+}
+
+// done records the outcome of a request to endpoint. If the load
+// balancer tracks outstanding requests, the request is counted as
+// finished once the response body is closed. Requests that were never
+// sent because the Authorization header could not be set are not
+// recorded.
+func (e *balancerEntry) done(r *http.Request, endpoint Endpoint, response *http.Response, err error) (*http.Response, error) {
+	var authErr *authHeaderError
+	if errors.As(err, &authErr) {
+		e.release(endpoint)
+		return nil, err
+	}
+
+	if e.outliers != nil && r.Context().Err() == nil {
+		e.outliers.record(endpoint, err != nil || response.StatusCode >= 500)
+	}
+
+	tracker, ok := e.lb.(TrackingLoadBalancer)
+	if !ok {
+		return response, err
+	}
+
+	if err != nil {
+		tracker.Done(endpoint)
+		return nil, err
+	}
+
+	response.Body = &doneBody{ReadCloser: response.Body, done: func() { tracker.Done(endpoint) }}
+	return response, nil
+}
+
+func (e *balancerEntry) close() {
+	e.lb.Close()
+	if e.outliers != nil {
+		e.outliers.close()
+	}
+}
+
+// endpointSelector is implemented by load balancers that can skip or
+// prefer endpoints, such as those embedding an endpointRefresher.
+type endpointSelector interface {
+	setExclude(exclude func(Endpoint) bool)
+	setRetain(retain func([]Endpoint))
+	setPrefer(prefer map[string]string)
+	reapply()
+}
+
+const defaultBalancerIdleTimeout = 5 * time.Minute
+
+// idTokenRefreshAhead is how long before expiry a cached ID token is
+// refreshed in the background.
+const idTokenRefreshAhead = 5 * time.Minute
+
+// IDTokenCacheStats returns the hit and miss counters for the ID
+// token cache used by the transport.
+func (t *Transport) IDTokenCacheStats() CacheStats {
+	return t.idTokenCache().Stats()
+}
+
+func (t *Transport) environment() *Environment {
+	if t.Environment != nil {
+		return t.Environment
+	}
+	return DefaultEnvironment
+}
+
+func (t *Transport) idTokenCache() *tokenCache {
+	t.idTokensOnce.Do(func() {
+		t.idTokens = newTokenCache(idTokenRefreshAhead, t.environment().fetchIDToken)
+	})
+	return t.idTokens
+}
+
+// idToken returns a cached ID token for the given audience.
+func (t *Transport) idToken(ctx context.Context, audience string) (string, error) {
+	idToken, err := t.idTokenCache().Get(ctx, audience)
+	if err != nil {
+		return "", err
+	}
+	return idToken.value, nil
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func (t *Transport) balancerIdleTimeout() time.Duration {
+	if t.BalancerIdleTimeout == 0 {
+		return defaultBalancerIdleTimeout
+	}
+	return t.BalancerIdleTimeout
+}
+
+// A balancerCall represents an in-flight load balancer creation.
+type balancerCall struct {
+	done  chan struct{}
+	entry *balancerEntry
+	err   error
+}
+
+// loadBalancer returns the load balancer for the given service,
+// creating it on first use.
+//
+// Concurrent requests for a new service share a single creation, which
+// runs without holding t.mu so a slow Service Directory lookup does not
+// block requests to other services. Creation is not bound to any one
+// request, but loadBalancer returns ctx.Err() if ctx is done first.
+func (t *Transport) loadBalancer(ctx context.Context, hostname *Hostname) (*balancerEntry, error) {
+	serviceNamespace := fmt.Sprintf("%s.%s", hostname.Service, hostname.Namespace)
+
+	t.mu.Lock()
+	if entry, ok := t.balancers[serviceNamespace]; ok {
+		entry.lastUsed = time.Now()
+		t.mu.Unlock()
+		return entry, nil
+	}
+
+	call, ok := t.creating[serviceNamespace]
+	if !ok {
+		call = &balancerCall{done: make(chan struct{})}
+		if t.creating == nil {
+			t.creating = make(map[string]*balancerCall)
+		}
+		t.creating[serviceNamespace] = call
+
+		go t.createLoadBalancer(serviceNamespace, hostname, call)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.entry, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// createLoadBalancer creates the load balancer for the given service
+// and stores it for later requests.
+func (t *Transport) createLoadBalancer(serviceNamespace string, hostname *Hostname, call *balancerCall) {
+	defer close(call.done)
+
+	entry, err := t.newBalancerEntry(serviceNamespace, hostname)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.creating, serviceNamespace)
+
+	if err != nil {
+		call.err = err
+		return
+	}
+
+	if t.balancers == nil {
+		t.balancers = make(map[string]*balancerEntry)
+	}
+	entry.lastUsed = time.Now()
+	t.balancers[serviceNamespace] = entry
+
+	if t.janitorStop == nil && t.balancerIdleTimeout() > 0 {
+		t.janitorStop = make(chan struct{})
+		go t.evictIdleBalancers(t.janitorStop)
+	}
+
+	call.entry = entry
+}
+
+// newBalancerEntry creates the load balancer and outlier detector for
+// the given service.
+func (t *Transport) newBalancerEntry(serviceNamespace string, hostname *Hostname) (*balancerEntry, error) {
+	policy := t.LoadBalancing[serviceNamespace]
+	lb, err := newLoadBalancer(context.Background(), t.environment(), hostname.Service, hostname.Namespace, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &balancerEntry{lb: lb}
+
+	if selector, ok := lb.(endpointSelector); ok {
+		if len(policy.Prefer) > 0 {
+			selector.setPrefer(policy.Prefer)
+		}
+		if t.OutlierDetection != nil {
+			entry.outliers = newOutlierDetector(t.OutlierDetection, selector.reapply)
+			selector.setExclude(entry.outliers.ejected)
+			selector.setRetain(entry.outliers.retain)
+		}
+	}
+
+	return entry, nil
+}
+
+// evictIdleBalancers periodically closes and discards load balancers
+// that have not been used within the idle timeout. It returns when
+// stop is closed or no load balancers remain.
+func (t *Transport) evictIdleBalancers(stop chan struct{}) {
+	timeout := t.balancerIdleTimeout()
+
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		t.mu.Lock()
+		for serviceNamespace, entry := range t.balancers {
+			if time.Since(entry.lastUsed) > timeout {
+				entry.close()
+				delete(t.balancers, serviceNamespace)
+			}
+		}
+
+		if len(t.balancers) == 0 {
+			if t.janitorStop == stop {
+				t.janitorStop = nil
+			}
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Close closes all load balancers created by the transport, stopping
+// their background endpoint refreshes. The transport remains usable;
+// load balancers are created again as needed.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.janitorStop != nil {
+		close(t.janitorStop)
+		t.janitorStop = nil
+	}
+
+	for serviceNamespace, entry := range t.balancers {
+		entry.close()
+		delete(t.balancers, serviceNamespace)
+	}
+
+	return nil
 }
 
+// RoundTrip implements http.RoundTripper. The request is cloned before
+// it is rewritten or its headers are modified.
+//
+// If the request context carries a TraceContext, such as one added by
+// TraceHandler, the X-Cloud-Trace-Context and traceparent headers are
+// set to continue the trace with a new span.
 func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
-	if t.Base == nil {
-		t.Base = http.DefaultTransport
+	response, err := t.roundTrip(r.Clone(r.Context()))
+	if err != nil && r.Body != nil {
+		// The request may fail before it is sent, so close the body
+		// as required of a RoundTripper.
+		r.Body.Close()
+	}
+
+	var authErr *authHeaderError
+	if errors.As(err, &authErr) {
+		return nil, authErr.err
+	}
+	return response, err
+}
+
+func (t *Transport) roundTrip(r *http.Request) (*http.Response, error) {
+	if err := injectTraceContext(r); err != nil {
+		return nil, err
+	}
+
+	if t.EnableServiceNameResolution {
+		if s, ok := parseServiceName(r.Host); ok && (s.Region != "" || DefaultNamespace == "") {
+			return t.roundTripServiceName(r, s, "")
+		}
 	}
 
 	hostname, err := parseHostname(r.Host)
 	if err != nil {
 		if t.InjectAuthHeader {
-			idToken, err := IDToken(audFromRequest(r))
-			if err != nil {
+			if err := t.injectAuthHeader(r, ""); err != nil {
 				return nil, err
 			}
-
-			r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", idToken))
 		}
-		return t.Base.RoundTrip(r)
+		return t.base().RoundTrip(r)
 	}
 
-	var loadBalancer *RoundRobinLoadBalancer
-
-	serviceNamespace := fmt.Sprintf("%s.%s", hostname.Service, hostname.Namespace)
-	if lb, ok := t.balancers[serviceNamespace]; ok {
-		loadBalancer = lb
-	} else {
-		l, err := NewRoundRobinLoadBalancer(hostname.Service, hostname.Namespace)
-		if err != nil {
-			return nil, err
-		}
+	loadBalancer, err := t.loadBalancer(r.Context(), hostname)
+	if errors.Is(err, ErrServiceNotFound) && t.FallbackToServiceURL {
+		return t.roundTripServiceURL(r, hostname)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		t.balancers[serviceNamespace] = l
-		loadBalancer = l
+	endpoint, err := loadBalancer.next(r)
+	if errors.Is(err, ErrNoEndpoints) && t.FallbackToServiceURL {
+		return t.roundTripServiceURL(r, hostname)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	endpoint := loadBalancer.Next()
+	if t.Retry != nil && replayable(r) {
+		return t.roundTripRetry(r, loadBalancer, endpoint)
+	}
 
-	address := endpoint.Address
-	port := endpoint.Port
+	response, err := t.roundTripEndpoint(r, endpoint)
+	return loadBalancer.done(r, endpoint, response, err)
+}
 
-	u, err := url.Parse(fmt.Sprintf("http://%s:%d", address, port))
+// roundTripEndpoint sends the request to a Service Directory endpoint.
+func (t *Transport) roundTripEndpoint(r *http.Request, endpoint Endpoint) (*http.Response, error) {
+	u, err := url.Parse(fmt.Sprintf("http://%s:%d", endpoint.Address, endpoint.Port))
 	if err != nil {
 		return nil, err
 	}
 
+	return t.roundTripTo(r, u, t.serviceAudience(r), t.InjectAuthHeader)
+}
+
+// serviceAudience returns the ID token audience for a request to a
+// Service Directory service: the audience configured for the service,
+// or the URL of the logical hostname the request was made to. It must
+// be called before the request is rewritten.
+func (t *Transport) serviceAudience(r *http.Request) string {
+	if hostname, err := parseHostname(r.Host); err == nil {
+		serviceNamespace := fmt.Sprintf("%s.%s", hostname.Service, hostname.Namespace)
+		if audience, ok := t.Audiences[serviceNamespace]; ok {
+			return audience
+		}
+	}
+	return audFromRequest(r)
+}
+
+// doneBody calls done once when the response body is closed.
+type doneBody struct {
+	io.ReadCloser
+
+	once sync.Once
+	done func()
+}
+
+func (b *doneBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// roundTripServiceURL sends the request to the public Cloud Run URL of
+// the named service.
+func (t *Transport) roundTripServiceURL(r *http.Request, hostname *Hostname) (*http.Response, error) {
+	serviceNamespace := fmt.Sprintf("%s.%s", hostname.Service, hostname.Namespace)
+	return t.roundTripServiceName(r, serviceName{Name: hostname.Service}, t.Audiences[serviceNamespace])
+}
+
+// roundTripTo rewrites the request to the scheme and host of u and
+// sends it, setting the Authorization header if inject is true. If
+// audience is empty, the ID token audience is the rewritten URL.
+func (t *Transport) roundTripTo(r *http.Request, u *url.URL, audience string, inject bool) (*http.Response, error) {
 	r.Host = u.Host
 	r.URL.Host = u.Host
 	r.URL.Scheme = u.Scheme
 	r.Header.Set("Host", u.Hostname())
 
-	if t.InjectAuthHeader {
-		idToken, err := IDToken(audFromRequest(r))
+	if inject {
+		if err := t.injectAuthHeader(r, audience); err != nil {
+			return nil, &authHeaderError{err}
+		}
+	}
+
+	return t.base().RoundTrip(r)
+}
+
+// An authHeaderError reports a failure to fetch the token for the
+// Authorization header. The request was never sent, so the error says
+// nothing about the health of the endpoint and is not retried.
+type authHeaderError struct {
+	err error
+}
+
+func (e *authHeaderError) Error() string { return e.err.Error() }
+
+func (e *authHeaderError) Unwrap() error { return e.err }
+
+// injectAuthHeader sets the Authorization header of the request to an
+// access token for requests to Google APIs, or an ID token otherwise.
+// The audience set on the request context with WithAudience takes
+// precedence over the given audience, which defaults to the request URL
+// if empty.
+func (t *Transport) injectAuthHeader(r *http.Request, audience string) error {
+	if t.PreserveAuthHeader && r.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	contextAudience, ok := audienceFromContext(r.Context())
+	if !ok && (t.UseAccessTokens || isGoogleAPI(r.URL.Hostname())) {
+		token, err := t.environment().Token(r.Context(), t.accessTokenScopes())
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		r.Header.Add("Authorization", fmt.Sprintf("Bearer %s", idToken))
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+		return nil
+	}
+
+	if ok {
+		audience = contextAudience
+	}
+	if audience == "" {
+		audience = audFromRequest(r)
+	}
+
+	idToken, err := t.idToken(r.Context(), audience)
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", idToken))
+	return nil
+}
+
+func (t *Transport) accessTokenScopes() []string {
+	if len(t.AccessTokenScopes) == 0 {
+		return []string{"https://www.googleapis.com/auth/cloud-platform"}
 	}
+	return t.AccessTokenScopes
+}
+
+// isGoogleAPI reports whether host is a Google API endpoint.
+func isGoogleAPI(host string) bool {
+	return host == "googleapis.com" || strings.HasSuffix(host, ".googleapis.com")
+}
+
+type audienceKey struct{}
+
+// WithAudience returns a copy of ctx that makes Transport request ID
+// tokens for the given audience, instead of one derived from the
+// request URL, for requests made with the returned context.
+func WithAudience(ctx context.Context, audience string) context.Context {
+	return context.WithValue(ctx, audienceKey{}, audience)
+}
 
-	return t.Base.RoundTrip(r)
+func audienceFromContext(ctx context.Context) (string, bool) {
+	audience, ok := ctx.Value(audienceKey{}).(string)
+	return audience, ok && audience != ""
 }
 
 type Hostname struct {
@@ -132,11 +628,12 @@ func parseHostname(host string) (*Hostname, error) {
 		hostname.Service = ss[0]
 	case 4:
 		domain := fmt.Sprintf("%s.%s", ss[2], ss[3])
-		if domain == DefaultRunDomain {
-			hostname.Domain = domain
-			hostname.Namespace = ss[1]
-			hostname.Service = ss[0]
+		if domain != DefaultRunDomain {
+			return nil, ErrInvalidHostname
 		}
+		hostname.Domain = domain
+		hostname.Namespace = ss[1]
+		hostname.Service = ss[0]
 	default:
 		return nil, ErrInvalidHostname
 	}
@@ -159,12 +656,13 @@ func audFromRequest(r *http.Request) string {
 //
 // ListenAndServe traps the SIGINT and SIGTERM signals then gracefully
 // shuts down the server without interrupting any active connections by
-// calling the server's Shutdown method.
+// calling the server's Shutdown method. If WithRegistration is given,
+// the instance is deregistered from Service Directory first.
 //
 // ListenAndServe always returns a non-nil error; under normal conditions
 // http.ErrServerClosed will be returned indicating a successful graceful
 // shutdown.
-func ListenAndServe(handler http.Handler) error {
+func ListenAndServe(handler http.Handler, opts ...ServeOption) error {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -174,19 +672,62 @@ func ListenAndServe(handler http.Handler) error {
 		handler = http.DefaultServeMux
 	}
 
+	var config serveConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+
 	addr := net.JoinHostPort("0.0.0.0", port)
 
 	h2s := &http2.Server{}
 	server := &http.Server{Addr: addr, Handler: h2c.NewHandler(handler, h2s)}
 
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalChan)
+
+	return serve(server, ln, &config, signalChan)
+}
+
+// serve serves on ln until a value is received from shutdown, then
+// deregisters the instance if registration is configured and gracefully
+// shuts down the server.
+func serve(server *http.Server, ln net.Listener, config *serveConfig, shutdown <-chan os.Signal) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registered := false
+	registrationDone := make(chan struct{})
+	if config.registration != nil {
+		go func() {
+			defer close(registrationDone)
+			registered = config.registration.run(ctx)
+		}()
+	} else {
+		close(registrationDone)
+	}
+
 	idleConnsClosed := make(chan struct{})
 	go func() {
-		signalChan := make(chan os.Signal, 1)
-		signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-		<-signalChan
+		<-shutdown
 
 		Notice("Received shutdown signal; waiting for active connections to close")
 
+		cancel()
+		<-registrationDone
+
+		if registered {
+			reg := config.registration
+			if err := reg.environment().DeregisterEndpoint(context.Background(), reg.Namespace); err != nil {
+				Error(fmt.Sprintf("Error deregistering endpoint: %v", err))
+			}
+		}
+
 		if err := server.Shutdown(context.Background()); err != nil {
 			Error("Error during server shutdown: %v", err)
 		}
@@ -194,7 +735,7 @@ func ListenAndServe(handler http.Handler) error {
 		close(idleConnsClosed)
 	}()
 
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	if err := server.Serve(ln); err != http.ErrServerClosed {
 		return err
 	}
 
@@ -1,10 +1,18 @@
 package run
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/kelseyhightower/run/internal/gcptest"
 )
@@ -21,16 +29,24 @@ func TestParseHostname(t *testing.T) {
 	}
 }
 
+func TestParseHostnameInvalidDomain(t *testing.T) {
+	for _, host := range []string{"www.example.co.uk", "ping.default.example.com"} {
+		if _, err := parseHostname(host); err != ErrInvalidHostname {
+			t.Errorf("%s: error mismatch; want %v, got %v", host, ErrInvalidHostname, err)
+		}
+	}
+}
+
 func TestTransport(t *testing.T) {
 	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
 	defer ms.Close()
 
-	metadataEndpoint = ms.URL
+	DefaultEnvironment.MetadataEndpoint = ms.URL
 
 	ss := httptest.NewServer(http.HandlerFunc(gcptest.ServiceDirectoryHandler))
 	defer ss.Close()
 
-	serviceDirectoryEndpoint = ss.URL
+	DefaultEnvironment.ServiceDirectoryEndpoint = ss.URL
 
 	var headers http.Header
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -43,7 +59,7 @@ func TestTransport(t *testing.T) {
 		Transport: &Transport{
 			Base:             http.DefaultTransport,
 			InjectAuthHeader: true,
-			balancers:        make(map[string]*RoundRobinLoadBalancer),
+			balancers:        make(map[string]*balancerEntry),
 		},
 	}
 
@@ -65,12 +81,12 @@ func TestTransportNameResolution(t *testing.T) {
 	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
 	defer ms.Close()
 
-	metadataEndpoint = ms.URL
+	DefaultEnvironment.MetadataEndpoint = ms.URL
 
 	ss := httptest.NewServer(http.HandlerFunc(gcptest.ServiceDirectoryHandler))
 	defer ss.Close()
 
-	serviceDirectoryEndpoint = ss.URL
+	DefaultEnvironment.ServiceDirectoryEndpoint = ss.URL
 
 	headers := make(http.Header)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -82,7 +98,7 @@ func TestTransportNameResolution(t *testing.T) {
 		Transport: &Transport{
 			Base:             http.DefaultTransport,
 			InjectAuthHeader: true,
-			balancers:        make(map[string]*RoundRobinLoadBalancer),
+			balancers:        make(map[string]*balancerEntry),
 		},
 	}
 
@@ -96,3 +112,557 @@ func TestTransportNameResolution(t *testing.T) {
 		t.Errorf("headers mismatch; want %s, got %s", "success", testHeader)
 	}
 }
+
+func TestTransportIDTokenCache(t *testing.T) {
+	var idTokenRequests int32
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/identity" {
+			atomic.AddInt32(&idTokenRequests, 1)
+		}
+		gcptest.MetadataHandler(w, r)
+	}))
+	defer ms.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ms.URL
+
+	var authHeader atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader.Store(r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+
+	tr := &Transport{InjectAuthHeader: true}
+	httpClient := &http.Client{Transport: tr}
+
+	for i := 0; i < 5; i++ {
+		response, err := httpClient.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		expectedAuthHeader := fmt.Sprintf("Bearer %s", gcptest.IDToken)
+		if got := authHeader.Load(); got != expectedAuthHeader {
+			t.Errorf("headers mismatch; want %s, got %s", expectedAuthHeader, got)
+		}
+	}
+
+	if n := atomic.LoadInt32(&idTokenRequests); n != 1 {
+		t.Errorf("id token request count mismatch; want 1, got %d", n)
+	}
+
+	stats := tr.IDTokenCacheStats()
+	if stats.Hits != 4 || stats.Misses != 1 {
+		t.Errorf("cache stats mismatch; want {4 1}, got %v", stats)
+	}
+}
+
+// testEndpoint returns a Service Directory endpoint for the given test
+// server.
+func testEndpoint(t *testing.T, ts *httptest.Server) gcptest.Endpoint {
+	t.Helper()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gcptest.Endpoint{
+		Name:    fmt.Sprintf("backend-%s", u.Port()),
+		Address: u.Hostname(),
+		Port:    port,
+	}
+}
+
+func TestClientConcurrentRequests(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ms.URL
+
+	var hits [3]int32
+	endpoints := make([]gcptest.Endpoint, 0)
+	for i := range hits {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+		}))
+		defer ts.Close()
+
+		endpoints = append(endpoints, testEndpoint(t, ts))
+	}
+
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "concurrent", endpoints)
+
+	ss := httptest.NewServer(sd)
+	defer ss.Close()
+
+	DefaultEnvironment.ServiceDirectoryEndpoint = ss.URL
+
+	defer Client.Transport.(*Transport).Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 6; j++ {
+				response, err := Client.Get("http://concurrent.test.run.local/")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				response.Body.Close()
+
+				if response.StatusCode != 200 {
+					t.Errorf("status code mismatch; want %v, got %v", 200, response.StatusCode)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range hits {
+		if n := atomic.LoadInt32(&hits[i]); n != 100 {
+			t.Errorf("backend %d request count mismatch; want 100, got %d", i, n)
+		}
+	}
+}
+
+func TestTransportEvictsIdleBalancers(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ms.URL
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "idle", []gcptest.Endpoint{testEndpoint(t, ts)})
+
+	ss := httptest.NewServer(sd)
+	defer ss.Close()
+
+	DefaultEnvironment.ServiceDirectoryEndpoint = ss.URL
+
+	tr := &Transport{BalancerIdleTimeout: 50 * time.Millisecond}
+	defer tr.Close()
+
+	response, err := (&http.Client{Transport: tr}).Get("http://idle.test.run.local/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	tr.mu.Lock()
+	entry, ok := tr.balancers["idle.test"]
+	tr.mu.Unlock()
+	if !ok {
+		t.Fatal("load balancer not created")
+	}
+
+	select {
+	case <-entry.lb.(*RoundRobinLoadBalancer).ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("idle load balancer not closed")
+	}
+
+	tr.mu.Lock()
+	n := len(tr.balancers)
+	tr.mu.Unlock()
+	if n != 0 {
+		t.Errorf("load balancer count mismatch; want 0, got %d", n)
+	}
+}
+
+func TestTransportClose(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ms.URL
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "close", []gcptest.Endpoint{testEndpoint(t, ts)})
+
+	ss := httptest.NewServer(sd)
+	defer ss.Close()
+
+	DefaultEnvironment.ServiceDirectoryEndpoint = ss.URL
+
+	tr := &Transport{}
+	httpClient := &http.Client{Transport: tr}
+
+	response, err := httpClient.Get("http://close.test.run.local/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	tr.mu.Lock()
+	lb := tr.balancers["close.test"].lb.(*RoundRobinLoadBalancer)
+	tr.mu.Unlock()
+
+	if err := tr.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if lb.ctx.Err() == nil {
+		t.Error("load balancer not closed")
+	}
+
+	// The transport remains usable after Close.
+	response, err = httpClient.Get("http://close.test.run.local/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	tr.Close()
+}
+
+func TestTransportNoEndpoints(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ms.URL
+
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "test", nil)
+
+	ss := httptest.NewServer(sd)
+	defer ss.Close()
+
+	DefaultEnvironment.ServiceDirectoryEndpoint = ss.URL
+
+	tr := &Transport{}
+	defer tr.Close()
+
+	_, err := (&http.Client{Transport: tr}).Get("http://test.test.run.local/")
+	if !errors.Is(err, ErrNoEndpoints) {
+		t.Errorf("error mismatch; want %v, got %v", ErrNoEndpoints, err)
+	}
+}
+
+// closeRecorder is a request body that records whether it was closed.
+type closeRecorder struct {
+	*strings.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTransportClosesBodyOnError(t *testing.T) {
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "test", nil)
+
+	e := serviceDirectoryEnvironment(t, sd)
+
+	tr := &Transport{Environment: e}
+	defer tr.Close()
+
+	body := &closeRecorder{Reader: strings.NewReader("test")}
+	r, err := http.NewRequest("POST", "http://test.test.run.local/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tr.RoundTrip(r); !errors.Is(err, ErrNoEndpoints) {
+		t.Errorf("error mismatch; want %v, got %v", ErrNoEndpoints, err)
+	}
+	if !body.closed {
+		t.Error("expected request body to be closed")
+	}
+}
+
+func TestTransportFallbackToServiceURL(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ms.URL
+
+	var authHeader string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+
+	cs := httptest.NewServer(gcptest.CloudrunServer(map[string]string{"test": ts.URL}))
+	defer cs.Close()
+
+	DefaultEnvironment.CloudRunEndpoint = cs.URL
+
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "test", nil)
+
+	ss := httptest.NewServer(sd)
+	defer ss.Close()
+
+	DefaultEnvironment.ServiceDirectoryEndpoint = ss.URL
+
+	tr := &Transport{FallbackToServiceURL: true}
+	defer tr.Close()
+
+	response, err := (&http.Client{Transport: tr}).Get("http://test.test.run.local/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	expectedAuthHeader := fmt.Sprintf("Bearer %s", gcptest.IDToken)
+	if authHeader != expectedAuthHeader {
+		t.Errorf("headers mismatch; want %s, got %s", expectedAuthHeader, authHeader)
+	}
+}
+
+func TestTransportFallbackToServiceURLUnregistered(t *testing.T) {
+	var authHeader string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+
+	cs := httptest.NewServer(gcptest.CloudrunServer(map[string]string{"test": ts.URL}))
+	defer cs.Close()
+
+	e := serviceDirectoryEnvironment(t, gcptest.NewServiceDirectory())
+	e.CloudRunEndpoint = cs.URL
+
+	tr := &Transport{Environment: e}
+	defer tr.Close()
+
+	if _, err := (&http.Client{Transport: tr}).Get("http://test.test.run.local/"); !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("error mismatch; want %v, got %v", ErrServiceNotFound, err)
+	}
+
+	tr.FallbackToServiceURL = true
+
+	response, err := (&http.Client{Transport: tr}).Get("http://test.test.run.local/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	expectedAuthHeader := fmt.Sprintf("Bearer %s", gcptest.IDToken)
+	if authHeader != expectedAuthHeader {
+		t.Errorf("headers mismatch; want %s, got %s", expectedAuthHeader, authHeader)
+	}
+}
+
+func TestTransportEndpointAudience(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	e := balancerEnvironment(t, []gcptest.Endpoint{testEndpoint(t, ts)})
+
+	var mu sync.Mutex
+	var audiences []string
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if audience := r.URL.Query().Get("audience"); audience != "" {
+			mu.Lock()
+			audiences = append(audiences, audience)
+			mu.Unlock()
+		}
+		gcptest.MetadataHandler(w, r)
+	}))
+	defer ms.Close()
+
+	e.MetadataEndpoint = ms.URL
+
+	tests := []struct {
+		audiences map[string]string
+		ctx       context.Context
+		want      string
+	}{
+		{nil, context.Background(), "http://test.test.run.local"},
+		{map[string]string{"test.test": "https://test-6bn2iswfgq-uw.a.run.app"}, context.Background(), "https://test-6bn2iswfgq-uw.a.run.app"},
+		{map[string]string{"test.test": "https://test-6bn2iswfgq-uw.a.run.app"}, WithAudience(context.Background(), "custom"), "custom"},
+	}
+
+	for i, tt := range tests {
+		tr := &Transport{Environment: e, InjectAuthHeader: true, Audiences: tt.audiences}
+
+		request, err := http.NewRequestWithContext(tt.ctx, "GET", "http://test.test.run.local/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := (&http.Client{Transport: tr}).Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		tr.Close()
+
+		mu.Lock()
+		got := audiences[len(audiences)-1]
+		mu.Unlock()
+
+		if got != tt.want {
+			t.Errorf("%d: audience mismatch; want %s, got %s", i, tt.want, got)
+		}
+	}
+}
+
+func TestTransportDoesNotModifyRequest(t *testing.T) {
+	var authHeaders []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeaders = r.Header.Values("Authorization")
+	}))
+	defer ts.Close()
+
+	e := balancerEnvironment(t, []gcptest.Endpoint{testEndpoint(t, ts)})
+
+	tests := []struct {
+		preserve bool
+		want     string
+	}{
+		{false, fmt.Sprintf("Bearer %s", gcptest.IDToken)},
+		{true, "Bearer caller"},
+	}
+
+	for _, tt := range tests {
+		tr := &Transport{Environment: e, InjectAuthHeader: true, PreserveAuthHeader: tt.preserve}
+
+		request, err := http.NewRequest("GET", "http://test.test.run.local/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer caller")
+
+		for i := 0; i < 2; i++ {
+			response, err := tr.RoundTrip(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+
+			if len(authHeaders) != 1 || authHeaders[0] != tt.want {
+				t.Errorf("preserve %v: authorization headers mismatch; want [%s], got %v", tt.preserve, tt.want, authHeaders)
+			}
+		}
+		tr.Close()
+
+		if request.Host != "test.test.run.local" || request.URL.String() != "http://test.test.run.local/" {
+			t.Errorf("request URL modified; got host %s, url %s", request.Host, request.URL)
+		}
+		if got := request.Header.Values("Authorization"); len(got) != 1 || got[0] != "Bearer caller" {
+			t.Errorf("request authorization header modified; got %v", got)
+		}
+	}
+}
+
+func TestTransportAccessTokens(t *testing.T) {
+	var scopes string
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s := r.URL.Query().Get("scopes"); s != "" {
+			scopes = s
+		}
+		gcptest.MetadataHandler(w, r)
+	}))
+	defer ms.Close()
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+
+	var authHeader string
+	base := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		authHeader = r.Header.Get("Authorization")
+		return &http.Response{StatusCode: 200, Body: http.NoBody, Request: r}, nil
+	})
+
+	accessToken := fmt.Sprintf("Bearer %s", gcptest.AccessToken.AccessToken)
+	idToken := fmt.Sprintf("Bearer %s", gcptest.IDToken)
+
+	tests := []struct {
+		url             string
+		useAccessTokens bool
+		want            string
+	}{
+		{"https://storage.googleapis.com/storage/v1/b", false, accessToken},
+		{"https://example-6bn2iswfgq-uw.a.run.app", false, idToken},
+		{"https://example-6bn2iswfgq-uw.a.run.app", true, accessToken},
+	}
+
+	for _, tt := range tests {
+		tr := &Transport{
+			Base:              base,
+			Environment:       e,
+			InjectAuthHeader:  true,
+			AccessTokenScopes: []string{"https://www.googleapis.com/auth/devstorage.read_only"},
+			UseAccessTokens:   tt.useAccessTokens,
+		}
+
+		response, err := (&http.Client{Transport: tr}).Get(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if authHeader != tt.want {
+			t.Errorf("%s: authorization header mismatch; want %s, got %s", tt.url, tt.want, authHeader)
+		}
+	}
+
+	if want := "https://www.googleapis.com/auth/devstorage.read_only"; scopes != want {
+		t.Errorf("scopes mismatch; want %s, got %s", want, scopes)
+	}
+}
+
+func TestTransportSlowDiscoveryDoesNotBlock(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "test", []gcptest.Endpoint{testEndpoint(t, ts)})
+	sd.SetEndpoints("slow", "test", nil)
+
+	release := make(chan struct{})
+	e := serviceDirectoryEnvironment(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/namespaces/slow/") {
+			<-release
+		}
+		sd.ServeHTTP(w, r)
+	}))
+	defer close(release)
+
+	tr := &Transport{Environment: e}
+	defer tr.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", "http://test.slow.run.local/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tr.RoundTrip(request)
+		errc <- err
+	}()
+
+	response, err := (&http.Client{Transport: tr, Timeout: time.Second}).Get("http://test.test.run.local/")
+	if err != nil {
+		t.Fatalf("request blocked by slow discovery: %v", err)
+	}
+	response.Body.Close()
+
+	if err := <-errc; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error mismatch; want %v, got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,193 @@
+package run
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrImpersonationPermissionDenied is returned when the caller is not
+// allowed to impersonate a service account.
+var ErrImpersonationPermissionDenied = errors.New("run: permission denied to impersonate service account")
+
+// ErrImpersonationUnauthorized is returned when calls to the IAM
+// Service Account Credentials API are unauthorized.
+var ErrImpersonationUnauthorized = errors.New("run: iam credentials api unauthorized")
+
+// ErrServiceAccountNotFound is returned when a service account is not
+// found.
+var ErrServiceAccountNotFound = errors.New("run: named service account not found")
+
+// ErrImpersonationUnknownError is return when calls to the IAM Service
+// Account Credentials API return an unknown error.
+var ErrImpersonationUnknownError = errors.New("run: unexpected error impersonating service account")
+
+// ErrImpersonationUnexpectedResponse is returned when calls to the IAM
+// Service Account Credentials API return an unexpected response.
+type ErrImpersonationUnexpectedResponse struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *ErrImpersonationUnexpectedResponse) Error() string {
+	return "run: unexpected error impersonating service account"
+}
+
+func (e *ErrImpersonationUnexpectedResponse) Unwrap() error { return e.Err }
+
+type generateAccessTokenRequest struct {
+	Scope    []string `json:"scope"`
+	Lifetime string   `json:"lifetime,omitempty"`
+}
+
+type generateAccessTokenResponse struct {
+	AccessToken string    `json:"accessToken"`
+	ExpireTime  time.Time `json:"expireTime"`
+}
+
+type generateIDTokenRequest struct {
+	Audience     string `json:"audience"`
+	IncludeEmail bool   `json:"includeEmail,omitempty"`
+}
+
+type generateIDTokenResponse struct {
+	Token string `json:"token"`
+}
+
+// ImpersonatedToken returns an access token for the given service
+// account, minted by the IAM Service Account Credentials API using the
+// default service account. The default service account must hold the
+// Service Account Token Creator role on the target service account.
+//
+// Tokens are cached like those returned by Token.
+func ImpersonatedToken(serviceAccount string, scopes []string) (*AccessToken, error) {
+	return DefaultEnvironment.ImpersonatedToken(context.Background(), serviceAccount, scopes)
+}
+
+// ImpersonatedTokenContext is like ImpersonatedToken but uses the given
+// context.
+func ImpersonatedTokenContext(ctx context.Context, serviceAccount string, scopes []string) (*AccessToken, error) {
+	return DefaultEnvironment.ImpersonatedToken(ctx, serviceAccount, scopes)
+}
+
+// ImpersonatedToken returns an access token for the given service
+// account, minted by the IAM Service Account Credentials API.
+func (e *Environment) ImpersonatedToken(ctx context.Context, serviceAccount string, scopes []string) (*AccessToken, error) {
+	t, err := e.impersonatedTokenCache().Get(ctx, serviceAccount+" "+scopesKey(scopes))
+	if err != nil {
+		return nil, err
+	}
+
+	return t.accessToken(), nil
+}
+
+func (e *Environment) fetchImpersonatedToken(ctx context.Context, key string) (*token, error) {
+	serviceAccount, scopes, _ := strings.Cut(key, " ")
+
+	request := generateAccessTokenRequest{
+		Scope: strings.Split(scopes, ","),
+	}
+
+	var response generateAccessTokenResponse
+	if err := e.iamCredentialsRequest(ctx, serviceAccount, "generateAccessToken", request, &response); err != nil {
+		return nil, err
+	}
+
+	t := &token{
+		value:     response.AccessToken,
+		tokenType: "Bearer",
+		expiry:    response.ExpireTime,
+	}
+
+	return t, nil
+}
+
+// ImpersonatedIDToken returns an id token for the given service
+// account and audience, minted by the IAM Service Account Credentials
+// API using the default service account.
+func ImpersonatedIDToken(serviceAccount, audience string) (string, error) {
+	return DefaultEnvironment.ImpersonatedIDToken(context.Background(), serviceAccount, audience)
+}
+
+// ImpersonatedIDTokenContext is like ImpersonatedIDToken but uses the
+// given context.
+func ImpersonatedIDTokenContext(ctx context.Context, serviceAccount, audience string) (string, error) {
+	return DefaultEnvironment.ImpersonatedIDToken(ctx, serviceAccount, audience)
+}
+
+// ImpersonatedIDToken returns an id token for the given service
+// account and audience, minted by the IAM Service Account Credentials
+// API.
+func (e *Environment) ImpersonatedIDToken(ctx context.Context, serviceAccount, audience string) (string, error) {
+	request := generateIDTokenRequest{
+		Audience:     audience,
+		IncludeEmail: true,
+	}
+
+	var response generateIDTokenResponse
+	if err := e.iamCredentialsRequest(ctx, serviceAccount, "generateIdToken", request, &response); err != nil {
+		return "", err
+	}
+
+	return response.Token, nil
+}
+
+// iamCredentialsRequest calls the given IAM Service Account Credentials
+// method for serviceAccount and decodes the response into v.
+func (e *Environment) iamCredentialsRequest(ctx context.Context, serviceAccount, method string, body, v interface{}) error {
+	ctx, cancel := e.withAPITimeout(ctx)
+	defer cancel()
+
+	token, err := e.Token(ctx, []string{"https://www.googleapis.com/auth/cloud-platform"})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:%s", e.IAMCredentialsEndpoint, serviceAccount, method)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("User-Agent", userAgent)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+
+	response, err := e.httpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch s := response.StatusCode; s {
+	case 200:
+		break
+	case 401:
+		return ErrImpersonationUnauthorized
+	case 403:
+		return ErrImpersonationPermissionDenied
+	case 404:
+		return ErrServiceAccountNotFound
+	default:
+		return &ErrImpersonationUnexpectedResponse{s, ErrImpersonationUnknownError}
+	}
+
+	data, err = io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
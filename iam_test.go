@@ -0,0 +1,118 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+var impersonatedTokenTests = []struct {
+	serviceAccount string
+	want           string
+	err            error
+}{
+	{gcptest.BackendAccountEmail, gcptest.ImpersonatedAccessToken, nil},
+	{gcptest.DeniedAccountEmail, "", ErrImpersonationPermissionDenied},
+	{"missing@test.iam.gserviceaccount.com", "", ErrServiceAccountNotFound},
+}
+
+func TestImpersonatedToken(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	var requests int32
+	is := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		gcptest.IAMCredentialsHandler(w, r)
+	}))
+	defer is.Close()
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+	e.IAMCredentialsEndpoint = is.URL
+
+	scopes := []string{"https://www.googleapis.com/auth/cloud-platform"}
+
+	for _, tt := range impersonatedTokenTests {
+		token, err := e.ImpersonatedToken(context.Background(), tt.serviceAccount, scopes)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("unexpected error, want %q, got %q", tt.err, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if token.AccessToken != tt.want {
+			t.Errorf("want %v, got %v", tt.want, token.AccessToken)
+		}
+
+		if token.ExpiresIn <= 0 {
+			t.Errorf("unexpected expires_in: %d", token.ExpiresIn)
+		}
+	}
+
+	// The backend token is served from the cache.
+	before := atomic.LoadInt32(&requests)
+	if _, err := e.ImpersonatedToken(context.Background(), gcptest.BackendAccountEmail, scopes); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != before {
+		t.Errorf("request count mismatch; want %d, got %d", before, n)
+	}
+}
+
+func TestImpersonatedIDToken(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	is := httptest.NewServer(http.HandlerFunc(gcptest.IAMCredentialsHandler))
+	defer is.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ms.URL
+	DefaultEnvironment.IAMCredentialsEndpoint = is.URL
+
+	idToken, err := ImpersonatedIDToken(gcptest.BackendAccountEmail, "https://test-0123456789-ue.a.run.app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if idToken != gcptest.ImpersonatedIDToken {
+		t.Errorf("want %v, got %v", gcptest.ImpersonatedIDToken, idToken)
+	}
+
+	_, err = ImpersonatedIDToken(gcptest.DeniedAccountEmail, "https://test-0123456789-ue.a.run.app")
+	if !errors.Is(err, ErrImpersonationPermissionDenied) {
+		t.Errorf("unexpected error, want %q, got %q", ErrImpersonationPermissionDenied, err)
+	}
+}
+
+func TestImpersonationUnauthorized(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" {
+			w.Write([]byte(`{"access_token":"invalid","expires_in":3600,"token_type":"Bearer"}`))
+			return
+		}
+		gcptest.MetadataHandler(w, r)
+	}))
+	defer ms.Close()
+
+	is := httptest.NewServer(http.HandlerFunc(gcptest.IAMCredentialsHandler))
+	defer is.Close()
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+	e.IAMCredentialsEndpoint = is.URL
+
+	_, err := e.ImpersonatedIDToken(context.Background(), gcptest.BackendAccountEmail, "https://example.com")
+	if !errors.Is(err, ErrImpersonationUnauthorized) {
+		t.Errorf("unexpected error, want %q, got %q", ErrImpersonationUnauthorized, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 // Service represents a Cloud Run service.
@@ -35,7 +36,21 @@ func CloudrunServer(services map[string]string) http.Handler {
 }
 
 func (h *cloudrunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	u := h.services["test"]
+	// Match the path suffix so regional endpoints formatted with a
+	// path prefix are also served.
+	const prefix = "/apis/serving.knative.dev/v1/namespaces/test/services/"
+
+	i := strings.Index(r.URL.Path, prefix)
+	if i == -1 {
+		http.Error(w, "", 500)
+		return
+	}
+
+	u, ok := h.services[r.URL.Path[i+len(prefix):]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
 
 	s := Service{
 		Status: ServiceStatus{
@@ -46,23 +61,11 @@ func (h *cloudrunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	path := r.URL.Path
-
-	if path == "/apis/serving.knative.dev/v1/namespaces/test/services/test" {
-		data, err := json.Marshal(s)
-		if err != nil {
-			http.Error(w, "", 500)
-			return
-		}
-
-		fmt.Fprint(w, string(data))
-		return
-	}
-
-	if path == "/apis/serving.knative.dev/v1/namespaces/test/services/not-found" {
-		http.NotFound(w, r)
+	data, err := json.Marshal(s)
+	if err != nil {
+		http.Error(w, "", 500)
 		return
 	}
 
-	http.Error(w, "", 500)
+	fmt.Fprint(w, string(data))
 }
@@ -0,0 +1,74 @@
+package gcptest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// ImpersonatedAccessToken is the access token minted for
+	// BackendAccountEmail by IAMCredentialsHandler.
+	ImpersonatedAccessToken = "ya29.impersonated-backend-token"
+
+	// ImpersonatedIDToken is the id token minted for
+	// BackendAccountEmail by IAMCredentialsHandler.
+	ImpersonatedIDToken = "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9.eyJleHAiOjQxMDI0NDQ4MDAsImVtYWlsIjoiYmFja2VuZEB0ZXN0LmlhbS5nc2VydmljZWFjY291bnQuY29tIn0.c2ln"
+
+	// DeniedAccountEmail is a service account the caller may not
+	// impersonate.
+	DeniedAccountEmail = "denied@test.iam.gserviceaccount.com"
+)
+
+// IAMCredentialsHandler serves the generateAccessToken and
+// generateIdToken methods of the IAM Service Account Credentials API.
+func IAMCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+AccessToken.AccessToken {
+		http.Error(w, "", 401)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "", 405)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/projects/-/serviceAccounts/")
+	email, method, _ := strings.Cut(name, ":")
+
+	switch email {
+	case BackendAccountEmail:
+	case DeniedAccountEmail:
+		http.Error(w, "", 403)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	var response interface{}
+	switch method {
+	case "generateAccessToken":
+		response = map[string]string{
+			"accessToken": ImpersonatedAccessToken,
+			"expireTime":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		}
+	case "generateIdToken":
+		response = map[string]string{
+			"token": ImpersonatedIDToken,
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
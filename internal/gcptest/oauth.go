@@ -0,0 +1,67 @@
+package gcptest
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	// ClientID and ClientSecret identify the OAuth client in
+	// ADCCredentials.
+	ClientID     = "test.apps.googleusercontent.com"
+	ClientSecret = "test-secret"
+
+	// RefreshToken is the refresh token accepted by OAuthTokenHandler.
+	RefreshToken = "1//test-refresh-token"
+
+	// UserAccessToken is the access token returned by OAuthTokenHandler.
+	UserAccessToken = "ya29.user-access-token"
+
+	// QuotaProjectID is the quota project in ADCCredentials.
+	QuotaProjectID = "adc-test"
+)
+
+// ADCCredentials is an application default credentials file of type
+// authorized_user, as written by gcloud.
+const ADCCredentials = `{
+  "client_id": "test.apps.googleusercontent.com",
+  "client_secret": "test-secret",
+  "quota_project_id": "adc-test",
+  "refresh_token": "1//test-refresh-token",
+  "type": "authorized_user"
+}`
+
+// OAuthTokenHandler serves the refresh_token grant of the Google OAuth
+// 2.0 token endpoint.
+func OAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "", 405)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != "refresh_token" ||
+		r.PostForm.Get("client_id") != ClientID ||
+		r.PostForm.Get("client_secret") != ClientSecret ||
+		r.PostForm.Get("refresh_token") != RefreshToken {
+		http.Error(w, `{"error":"invalid_grant"}`, 400)
+		return
+	}
+
+	data, err := json.Marshal(AccessTokenResponse{
+		AccessToken: UserAccessToken,
+		ExpiresIn:   3599,
+		TokenType:   "Bearer",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -1,8 +1,12 @@
 package gcptest
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 var testEndpoints = `{
@@ -34,3 +38,425 @@ func ServiceDirectoryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// Endpoint represents a Service Directory endpoint.
+type Endpoint struct {
+	Name        string            `json:"name"`
+	Address     string            `json:"address"`
+	Port        int               `json:"port"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Namespace represents a Service Directory namespace.
+type Namespace struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// DirectoryService represents a Service Directory service. Endpoints are only
+// included when the service is resolved.
+type DirectoryService struct {
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Endpoints   []Endpoint        `json:"endpoints,omitempty"`
+}
+
+// A ServiceDirectory is an in-memory Service Directory stand-in for
+// the test project and region. It serves the namespace, service, and
+// endpoint methods of the Service Directory API and is safe for
+// concurrent use.
+//
+// Endpoint lists support filters of the form annotations.KEY="VALUE",
+// joined with AND.
+type ServiceDirectory struct {
+	// PageSize optionally limits the number of endpoints returned per
+	// page. It must be set before the ServiceDirectory is used.
+	PageSize int
+
+	mu         sync.Mutex
+	namespaces map[string]*sdNamespace
+}
+
+type sdNamespace struct {
+	labels   map[string]string
+	services map[string]*sdService
+}
+
+type sdService struct {
+	annotations map[string]string
+	endpoints   []Endpoint
+}
+
+// NewServiceDirectory returns an empty ServiceDirectory.
+func NewServiceDirectory() *ServiceDirectory {
+	return &ServiceDirectory{namespaces: make(map[string]*sdNamespace)}
+}
+
+// SetEndpoints replaces the endpoints of the named service, creating
+// the namespace and service if needed.
+func (sd *ServiceDirectory) SetEndpoints(namespace, service string, endpoints []Endpoint) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	ns, ok := sd.namespaces[namespace]
+	if !ok {
+		ns = &sdNamespace{services: make(map[string]*sdService)}
+		sd.namespaces[namespace] = ns
+	}
+
+	svc, ok := ns.services[service]
+	if !ok {
+		svc = &sdService{}
+		ns.services[service] = svc
+	}
+
+	svc.endpoints = endpoints
+}
+
+// Endpoints returns the endpoints of the named service.
+func (sd *ServiceDirectory) Endpoints(namespace, service string) []Endpoint {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	ns, ok := sd.namespaces[namespace]
+	if !ok {
+		return nil
+	}
+	svc, ok := ns.services[service]
+	if !ok {
+		return nil
+	}
+
+	return append([]Endpoint(nil), svc.endpoints...)
+}
+
+func (sd *ServiceDirectory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := fmt.Sprintf("/v1/projects/%s/locations/%s/namespaces", ProjectID, Region)
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	var segments []string
+	if rest := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"); rest != "" {
+		segments = strings.Split(rest, "/")
+	}
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	switch len(segments) {
+	case 0:
+		sd.namespaceCollection(w, r)
+	case 1:
+		sd.namespace(w, r, segments[0])
+	case 2:
+		if segments[1] != "services" {
+			http.NotFound(w, r)
+			return
+		}
+		sd.serviceCollection(w, r, segments[0])
+	case 3:
+		sd.service(w, r, segments[0], segments[2])
+	case 4:
+		if segments[3] != "endpoints" {
+			http.NotFound(w, r)
+			return
+		}
+		sd.endpointCollection(w, r, segments[0], segments[2])
+	case 5:
+		sd.endpoint(w, r, segments[0], segments[2], segments[4])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (sd *ServiceDirectory) namespaceCollection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "", 405)
+		return
+	}
+
+	id := r.URL.Query().Get("namespaceId")
+	if _, ok := sd.namespaces[id]; ok {
+		http.Error(w, "", 409)
+		return
+	}
+
+	var namespace Namespace
+	if !decodeBody(w, r, &namespace) {
+		return
+	}
+
+	sd.namespaces[id] = &sdNamespace{labels: namespace.Labels, services: make(map[string]*sdService)}
+	writeJSON(w, Namespace{Name: namespacePath(id), Labels: namespace.Labels})
+}
+
+func (sd *ServiceDirectory) namespace(w http.ResponseWriter, r *http.Request, id string) {
+	ns, ok := sd.namespaces[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, Namespace{Name: namespacePath(id), Labels: ns.labels})
+	case http.MethodDelete:
+		delete(sd.namespaces, id)
+		writeJSON(w, struct{}{})
+	default:
+		http.Error(w, "", 405)
+	}
+}
+
+func (sd *ServiceDirectory) serviceCollection(w http.ResponseWriter, r *http.Request, namespace string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "", 405)
+		return
+	}
+
+	ns, ok := sd.namespaces[namespace]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	id := r.URL.Query().Get("serviceId")
+	if _, ok := ns.services[id]; ok {
+		http.Error(w, "", 409)
+		return
+	}
+
+	var service DirectoryService
+	if !decodeBody(w, r, &service) {
+		return
+	}
+
+	ns.services[id] = &sdService{annotations: service.Annotations}
+	writeJSON(w, DirectoryService{Name: servicePath(namespace, id), Annotations: service.Annotations})
+}
+
+func (sd *ServiceDirectory) service(w http.ResponseWriter, r *http.Request, namespace, id string) {
+	id, method, _ := strings.Cut(id, ":")
+
+	ns, ok := sd.namespaces[namespace]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	svc, ok := ns.services[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case method == "resolve" && r.Method == http.MethodPost:
+		writeJSON(w, map[string]DirectoryService{
+			"service": {Name: servicePath(namespace, id), Annotations: svc.annotations, Endpoints: svc.endpoints},
+		})
+	case method == "" && r.Method == http.MethodGet:
+		writeJSON(w, DirectoryService{Name: servicePath(namespace, id), Annotations: svc.annotations})
+	case method == "" && r.Method == http.MethodDelete:
+		delete(ns.services, id)
+		writeJSON(w, struct{}{})
+	default:
+		http.Error(w, "", 405)
+	}
+}
+
+func (sd *ServiceDirectory) lookupService(w http.ResponseWriter, r *http.Request, namespace, service string) (*sdService, bool) {
+	ns, ok := sd.namespaces[namespace]
+	if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+
+	svc, ok := ns.services[service]
+	if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return svc, true
+}
+
+func (sd *ServiceDirectory) endpointCollection(w http.ResponseWriter, r *http.Request, namespace, service string) {
+	svc, ok := sd.lookupService(w, r, namespace, service)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sd.listEndpoints(w, r, svc.endpoints)
+	case http.MethodPost:
+		id := r.URL.Query().Get("endpointId")
+		if findEndpoint(svc.endpoints, id) >= 0 {
+			http.Error(w, "", 409)
+			return
+		}
+
+		var endpoint Endpoint
+		if !decodeBody(w, r, &endpoint) {
+			return
+		}
+
+		endpoint.Name = servicePath(namespace, service) + "/endpoints/" + id
+		svc.endpoints = append(svc.endpoints, endpoint)
+		writeJSON(w, endpoint)
+	default:
+		http.Error(w, "", 405)
+	}
+}
+
+func (sd *ServiceDirectory) endpoint(w http.ResponseWriter, r *http.Request, namespace, service, id string) {
+	svc, ok := sd.lookupService(w, r, namespace, service)
+	if !ok {
+		return
+	}
+
+	i := findEndpoint(svc.endpoints, id)
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, svc.endpoints[i])
+	case http.MethodPatch:
+		var update Endpoint
+		if !decodeBody(w, r, &update) {
+			return
+		}
+
+		endpoint := svc.endpoints[i]
+		for _, field := range strings.Split(r.URL.Query().Get("updateMask"), ",") {
+			switch field {
+			case "address":
+				endpoint.Address = update.Address
+			case "port":
+				endpoint.Port = update.Port
+			case "annotations":
+				endpoint.Annotations = update.Annotations
+			default:
+				http.Error(w, fmt.Sprintf("unsupported update mask field %q", field), 400)
+				return
+			}
+		}
+
+		svc.endpoints[i] = endpoint
+		writeJSON(w, endpoint)
+	case http.MethodDelete:
+		svc.endpoints = append(svc.endpoints[:i:i], svc.endpoints[i+1:]...)
+		writeJSON(w, struct{}{})
+	default:
+		http.Error(w, "", 405)
+	}
+}
+
+func (sd *ServiceDirectory) listEndpoints(w http.ResponseWriter, r *http.Request, endpoints []Endpoint) {
+	match, err := parseFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var matched []Endpoint
+	for _, endpoint := range endpoints {
+		if match(endpoint) {
+			matched = append(matched, endpoint)
+		}
+	}
+
+	start := 0
+	if pageToken := r.URL.Query().Get("pageToken"); pageToken != "" {
+		start, err = strconv.Atoi(pageToken)
+		if err != nil || start < 0 || start > len(matched) {
+			http.Error(w, "invalid page token", 400)
+			return
+		}
+	}
+
+	response := struct {
+		Endpoints     []Endpoint `json:"endpoints"`
+		NextPageToken string     `json:"nextPageToken,omitempty"`
+	}{Endpoints: matched[start:]}
+
+	if sd.PageSize > 0 && len(response.Endpoints) > sd.PageSize {
+		response.Endpoints = response.Endpoints[:sd.PageSize]
+		response.NextPageToken = strconv.Itoa(start + sd.PageSize)
+	}
+
+	writeJSON(w, response)
+}
+
+// findEndpoint returns the index of the endpoint with the given ID, or
+// -1 if there is none.
+func findEndpoint(endpoints []Endpoint, id string) int {
+	for i, endpoint := range endpoints {
+		if endpoint.Name == id || strings.HasSuffix(endpoint.Name, "/endpoints/"+id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), 400)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// parseFilter returns a function reporting whether an endpoint matches
+// the filter.
+func parseFilter(filter string) (func(Endpoint) bool, error) {
+	annotations := make(map[string]string)
+
+	if filter != "" {
+		for _, term := range strings.Split(filter, " AND ") {
+			key, value, ok := strings.Cut(strings.TrimSpace(term), "=")
+			if !ok || !strings.HasPrefix(key, "annotations.") {
+				return nil, fmt.Errorf("unsupported filter %q", filter)
+			}
+
+			v, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("unsupported filter %q", filter)
+			}
+			annotations[strings.TrimPrefix(key, "annotations.")] = v
+		}
+	}
+
+	return func(endpoint Endpoint) bool {
+		for k, v := range annotations {
+			if endpoint.Annotations[k] != v {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func namespacePath(namespace string) string {
+	return fmt.Sprintf("projects/%s/locations/%s/namespaces/%s", ProjectID, Region, namespace)
+}
+
+func servicePath(namespace, service string) string {
+	return namespacePath(namespace) + "/services/" + service
+}
@@ -0,0 +1,94 @@
+package gcptest
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MetadataStore is a metadata server stand-in whose values can be
+// changed while it is serving. It supports the wait_for_change,
+// last_etag, and timeout_sec query parameters so long-poll watches can
+// be tested offline.
+//
+// Requests for keys that have not been set are served by
+// MetadataHandler.
+type MetadataStore struct {
+	mu      sync.Mutex
+	values  map[string]string
+	changed chan struct{}
+}
+
+// NewMetadataStore returns an empty MetadataStore.
+func NewMetadataStore() *MetadataStore {
+	return &MetadataStore{
+		values:  make(map[string]string),
+		changed: make(chan struct{}),
+	}
+}
+
+// Set sets the value of key, a path relative to /computeMetadata/v1/,
+// and wakes any requests waiting for a change.
+func (m *MetadataStore) Set(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[key] = value
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *MetadataStore) get(key string) (string, bool, chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, ok := m.values[key]
+	return v, ok, m.changed
+}
+
+func (m *MetadataStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1/")
+
+	v, ok, changed := m.get(key)
+	if !ok {
+		MetadataHandler(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("wait_for_change") == "true" && query.Get("last_etag") == etag(v) {
+		timeout := 60 * time.Second
+		if s, err := strconv.Atoi(query.Get("timeout_sec")); err == nil {
+			timeout = time.Duration(s) * time.Second
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+	wait:
+		for {
+			select {
+			case <-changed:
+				v, _, changed = m.get(key)
+				if etag(v) != query.Get("last_etag") {
+					break wait
+				}
+			case <-timer.C:
+				break wait
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	w.Header().Set("ETag", etag(v))
+	fmt.Fprint(w, v)
+}
+
+func etag(v string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(v)))[:16]
+}
@@ -1,6 +1,7 @@
 package run
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -150,7 +151,8 @@ func (l *Logger) Notice(v ...interface{}) {
 //
 // If the first value is an *http.Request, the X-Cloud-Trace-Context
 // HTTP header will be extracted and included in the Stackdriver log
-// entry.
+// entry. If the first value is a context.Context carrying a
+// TraceContext, its trace ID is included instead.
 //
 // Source file location data will be included in log entires.
 //
@@ -184,7 +186,8 @@ func (l *Logger) Log(severity string, v ...interface{}) {
 
 	// The first argument was an *http.Request or context object
 	// and is not part of the message
-	if _, ok := v[0].(*http.Request); ok {
+	switch v[0].(type) {
+	case *http.Request, context.Context:
 		v = v[1:]
 	}
 
@@ -232,6 +235,10 @@ func extractTraceID(v interface{}) string {
 		if len(ts) > 0 && len(ts[0]) > 0 {
 			trace = ts[0]
 		}
+	case context.Context:
+		if tc, ok := TraceContextFromContext(t); ok {
+			trace = tc.TraceID
+		}
 	default:
 		trace = ""
 	}
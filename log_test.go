@@ -2,6 +2,7 @@ package run
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -91,7 +92,7 @@ func TestLoggerWithTraceID(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
 	defer ts.Close()
 
-	metadataEndpoint = ts.URL
+	DefaultEnvironment.MetadataEndpoint = ts.URL
 
 	buf := new(bytes.Buffer)
 	SetOutput(buf)
@@ -122,3 +123,31 @@ func TestLoggerWithTraceID(t *testing.T) {
 		t.Errorf("log severity mismatch, want %s, got %s", severity, le.Severity)
 	}
 }
+
+func TestLoggerWithTraceContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ts.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ts.URL
+
+	buf := new(bytes.Buffer)
+	SetOutput(buf)
+
+	traceID := "27abb75176a19ccf353146b192ef419f"
+	ctx := WithTraceContext(context.Background(), TraceContext{TraceID: traceID, SpanID: 1})
+
+	Info(ctx, "message")
+
+	var le LogEntry
+	if err := json.Unmarshal(buf.Bytes(), &le); err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("projects/%s/traces/%s", gcptest.ProjectID, traceID)
+	if le.Trace != want {
+		t.Errorf("log traceID mismatch, want %s, got %s", want, le.Trace)
+	}
+	if le.Message != "message" {
+		t.Errorf("log message mismatch, want %s, got %s", "message", le.Message)
+	}
+}
@@ -1,27 +1,22 @@
 package run
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"path"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 )
 
-var rmu sync.Mutex
-
-var (
-	runtimeID               string
-	runtimeProjectID        string
-	runtimeRegion           string
-	runtimeNumericProjectID string
-)
-
-var metadataEndpoint = "http://metadata.google.internal"
+// accessTokenRefreshAhead is how long before expiry a cached access
+// token is refreshed in the background.
+const accessTokenRefreshAhead = 3 * time.Minute
 
 // ErrMetadataNotFound is returned when a metadata key is not found.
 var ErrMetadataNotFound = errors.New("run: metadata key not found")
@@ -46,6 +41,14 @@ func (e *ErrMetadataUnexpectedResponse) Error() string {
 
 func (e *ErrMetadataUnexpectedResponse) Unwrap() error { return e.Err }
 
+// ServiceAccount describes a service account attached to the
+// container instance.
+type ServiceAccount struct {
+	Email   string   `json:"email"`
+	Aliases []string `json:"aliases"`
+	Scopes  []string `json:"scopes"`
+}
+
 // AccessToken holds a GCP access token.
 type AccessToken struct {
 	AccessToken string `json:"access_token"`
@@ -55,116 +58,554 @@ type AccessToken struct {
 
 // ProjectID returns the active project ID from the metadata service.
 func ProjectID() (string, error) {
-	rmu.Lock()
-	defer rmu.Unlock()
+	return DefaultEnvironment.ProjectID(context.Background())
+}
+
+// ProjectIDContext is like ProjectID but uses the given context.
+func ProjectIDContext(ctx context.Context) (string, error) {
+	return DefaultEnvironment.ProjectID(ctx)
+}
+
+// ProjectID returns the active project ID from the metadata service.
+func (e *Environment) ProjectID(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
-	if runtimeProjectID != "" {
-		return runtimeProjectID, nil
+	if e.projectID != "" {
+		return e.projectID, nil
 	}
 
-	endpoint := fmt.Sprintf("%s/computeMetadata/v1/project/project-id", metadataEndpoint)
+	projectID, err := e.fromSource(ctx, "project",
+		func() (string, error) {
+			endpoint := fmt.Sprintf("%s/computeMetadata/v1/project/project-id", e.MetadataEndpoint)
 
-	data, err := metadataRequest(endpoint)
+			data, err := e.metadataRequest(ctx, endpoint)
+			return string(data), err
+		},
+		func(s MetadataSource) (string, error) {
+			return s.ProjectID(ctx)
+		})
 	if err != nil {
 		return "", err
 	}
 
-	runtimeProjectID = string(data)
-	return runtimeProjectID, nil
+	e.projectID = projectID
+	return e.projectID, nil
 }
 
 // NumericProjectID returns the active project ID from the metadata service.
 func NumericProjectID() (string, error) {
-	rmu.Lock()
-	defer rmu.Unlock()
+	return DefaultEnvironment.NumericProjectID(context.Background())
+}
+
+// NumericProjectIDContext is like NumericProjectID but uses the given context.
+func NumericProjectIDContext(ctx context.Context) (string, error) {
+	return DefaultEnvironment.NumericProjectID(ctx)
+}
 
-	if runtimeNumericProjectID != "" {
-		return runtimeNumericProjectID, nil
+// NumericProjectID returns the active project ID from the metadata service.
+//
+// Fallback sources do not know the project number, so when the metadata
+// server is unreachable ErrMetadataUnavailable is returned.
+func (e *Environment) NumericProjectID(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.numericProjectID != "" {
+		return e.numericProjectID, nil
 	}
 
-	endpoint := fmt.Sprintf("%s/computeMetadata/v1/project/numeric-project-id", metadataEndpoint)
+	numericProjectID, err := e.fromSource(ctx, "numeric-project",
+		func() (string, error) {
+			endpoint := fmt.Sprintf("%s/computeMetadata/v1/project/numeric-project-id", e.MetadataEndpoint)
 
-	data, err := metadataRequest(endpoint)
+			data, err := e.metadataRequest(ctx, endpoint)
+			return string(data), err
+		},
+		func(s MetadataSource) (string, error) {
+			return "", ErrMetadataNotFound
+		})
 	if err != nil {
 		return "", err
 	}
 
-	runtimeNumericProjectID = string(data)
-	return runtimeNumericProjectID, nil
+	e.numericProjectID = numericProjectID
+	return e.numericProjectID, nil
 }
 
 // Token returns the default service account token.
+//
+// Tokens are cached per set of scopes until they expire and are
+// refreshed in the background shortly before expiry.
 func Token(scopes []string) (*AccessToken, error) {
-	s := strings.Join(scopes, ",")
+	return DefaultEnvironment.Token(context.Background(), scopes)
+}
+
+// TokenContext is like Token but uses the given context.
+//
+// Cancelling ctx stops waiting for a token; a fetch shared with other
+// callers continues on their behalf.
+func TokenContext(ctx context.Context, scopes []string) (*AccessToken, error) {
+	return DefaultEnvironment.Token(ctx, scopes)
+}
+
+// Token returns the default service account token.
+func (e *Environment) Token(ctx context.Context, scopes []string) (*AccessToken, error) {
+	return e.ServiceAccountToken(ctx, "default", scopes)
+}
 
-	endpoint := fmt.Sprintf("%s/computeMetadata/v1/instance/service-accounts/default/token?scopes=%s", metadataEndpoint, s)
-	data, err := metadataRequest(endpoint)
+// ServiceAccountToken returns an access token for the given service
+// account attached to the container instance. The account is either
+// an email address or an alias such as "default".
+//
+// Tokens are cached like those returned by Token.
+func ServiceAccountToken(account string, scopes []string) (*AccessToken, error) {
+	return DefaultEnvironment.ServiceAccountToken(context.Background(), account, scopes)
+}
+
+// ServiceAccountTokenContext is like ServiceAccountToken but uses the
+// given context.
+func ServiceAccountTokenContext(ctx context.Context, account string, scopes []string) (*AccessToken, error) {
+	return DefaultEnvironment.ServiceAccountToken(ctx, account, scopes)
+}
+
+// ServiceAccountToken returns an access token for the given service
+// account attached to the container instance.
+func (e *Environment) ServiceAccountToken(ctx context.Context, account string, scopes []string) (*AccessToken, error) {
+	t, err := e.tokenCache().Get(ctx, account+" "+scopesKey(scopes))
+	if err != nil {
+		return nil, err
+	}
+
+	return t.accessToken(), nil
+}
+
+// fetchToken fetches an access token from the metadata server. The key
+// holds the service account and the comma separated scopes.
+func (e *Environment) fetchToken(ctx context.Context, key string) (*token, error) {
+	account, scopes, _ := strings.Cut(key, " ")
+
+	if account == "default" && e.metadataUnreachable() {
+		return e.fetchFallbackToken(ctx, strings.Split(scopes, ","))
+	}
+
+	endpoint := fmt.Sprintf("%s/computeMetadata/v1/instance/service-accounts/%s/token?scopes=%s", e.MetadataEndpoint, account, scopes)
+	data, err := e.metadataRequest(ctx, endpoint)
+	if account == "default" && e.checkUnreachable(err) {
+		return e.fetchFallbackToken(ctx, strings.Split(scopes, ","))
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if account == "default" {
+		e.recordSource("token", MetadataServerSource)
+	}
+
 	var accessToken AccessToken
 	err = json.Unmarshal(data, &accessToken)
 	if err != nil {
 		return nil, fmt.Errorf("run/metadata: error retrieving access token: %v", err)
 	}
 
-	return &accessToken, nil
+	t := &token{
+		value:     accessToken.AccessToken,
+		tokenType: accessToken.TokenType,
+		expiry:    time.Now().Add(time.Duration(accessToken.ExpiresIn) * time.Second),
+	}
+
+	return t, nil
+}
+
+// fetchFallbackToken fetches an access token from the first fallback
+// source that supplies one.
+func (e *Environment) fetchFallbackToken(ctx context.Context, scopes []string) (*token, error) {
+	for _, source := range e.FallbackSources {
+		accessToken, err := source.Token(ctx, scopes)
+		if errors.Is(err, ErrMetadataNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		e.recordSource("token", source.Name())
+
+		t := &token{
+			value:     accessToken.AccessToken,
+			tokenType: accessToken.TokenType,
+			expiry:    time.Now().Add(time.Duration(accessToken.ExpiresIn) * time.Second),
+		}
+		return t, nil
+	}
+
+	return nil, ErrMetadataUnavailable
 }
 
 // IDToken returns an id token based on the service url.
 func IDToken(serviceURL string) (string, error) {
-	endpoint := fmt.Sprintf("%s/computeMetadata/v1/instance/service-accounts/default/identity?audience=%s", metadataEndpoint, serviceURL)
+	return DefaultEnvironment.IDToken(context.Background(), serviceURL)
+}
+
+// IDTokenContext is like IDToken but uses the given context.
+func IDTokenContext(ctx context.Context, serviceURL string) (string, error) {
+	return DefaultEnvironment.IDToken(ctx, serviceURL)
+}
+
+// IDToken returns an id token based on the service url.
+func (e *Environment) IDToken(ctx context.Context, serviceURL string) (string, error) {
+	return e.ServiceAccountIDToken(ctx, "default", serviceURL)
+}
+
+// ServiceAccountIDToken returns an id token for the given service
+// account attached to the container instance. The account is either
+// an email address or an alias such as "default".
+func ServiceAccountIDToken(account, audience string) (string, error) {
+	return DefaultEnvironment.ServiceAccountIDToken(context.Background(), account, audience)
+}
 
-	idToken, err := metadataRequest(endpoint)
+// ServiceAccountIDTokenContext is like ServiceAccountIDToken but uses
+// the given context.
+func ServiceAccountIDTokenContext(ctx context.Context, account, audience string) (string, error) {
+	return DefaultEnvironment.ServiceAccountIDToken(ctx, account, audience)
+}
+
+// ServiceAccountIDToken returns an id token for the given service
+// account attached to the container instance.
+func (e *Environment) ServiceAccountIDToken(ctx context.Context, account, audience string) (string, error) {
+	endpoint := fmt.Sprintf("%s/computeMetadata/v1/instance/service-accounts/%s/identity?audience=%s", e.MetadataEndpoint, account, audience)
+
+	idToken, err := e.metadataRequest(ctx, endpoint)
 	if err != nil {
 		return "", fmt.Errorf("metadata.Get: failed to query id_token: %w", err)
 	}
 	return string(idToken), nil
 }
 
+func (e *Environment) fetchIDToken(ctx context.Context, audience string) (*token, error) {
+	idToken, err := e.IDToken(ctx, audience)
+	if err != nil {
+		return nil, err
+	}
+
+	return idTokenFromJWT(idToken)
+}
+
 // Region returns the name of the Cloud Run region.
 func Region() (string, error) {
-	rmu.Lock()
-	defer rmu.Unlock()
+	return DefaultEnvironment.Region(context.Background())
+}
 
-	if runtimeRegion != "" {
-		return runtimeRegion, nil
-	}
+// RegionContext is like Region but uses the given context.
+func RegionContext(ctx context.Context) (string, error) {
+	return DefaultEnvironment.Region(ctx)
+}
 
-	endpoint := fmt.Sprintf("%s/computeMetadata/v1/instance/region", metadataEndpoint)
+// Region returns the name of the Cloud Run region.
+func (e *Environment) Region(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.region != "" {
+		return e.region, nil
+	}
 
-	data, err := metadataRequest(endpoint)
+	region, err := e.fromSource(ctx, "region",
+		func() (string, error) {
+			endpoint := fmt.Sprintf("%s/computeMetadata/v1/instance/region", e.MetadataEndpoint)
+
+			data, err := e.metadataRequest(ctx, endpoint)
+			if err != nil {
+				return "", err
+			}
+			return path.Base(string(data)), nil
+		},
+		func(s MetadataSource) (string, error) {
+			return s.Region(ctx)
+		})
 	if err != nil {
 		return "", err
 	}
 
-	runtimeRegion = path.Base(string(data))
-	return runtimeRegion, nil
+	e.region = region
+	return e.region, nil
 }
 
 // ID returns the unique identifier of the container instance.
 func ID() (string, error) {
-	rmu.Lock()
-	defer rmu.Unlock()
+	return DefaultEnvironment.ID(context.Background())
+}
+
+// IDContext is like ID but uses the given context.
+func IDContext(ctx context.Context) (string, error) {
+	return DefaultEnvironment.ID(ctx)
+}
+
+// ID returns the unique identifier of the container instance.
+func (e *Environment) ID(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.id != "" {
+		return e.id, nil
+	}
+
+	endpoint := fmt.Sprintf("%s/computeMetadata/v1/instance/id", e.MetadataEndpoint)
+
+	data, err := e.metadataRequest(ctx, endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	e.id = string(data)
+	return e.id, nil
+}
 
-	if runtimeID != "" {
-		return runtimeID, nil
+// Zone returns the name of the zone the container instance is running in.
+func Zone() (string, error) {
+	return DefaultEnvironment.Zone(context.Background())
+}
+
+// ZoneContext is like Zone but uses the given context.
+func ZoneContext(ctx context.Context) (string, error) {
+	return DefaultEnvironment.Zone(ctx)
+}
+
+// Zone returns the name of the zone the container instance is running in.
+func (e *Environment) Zone(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.zone != "" {
+		return e.zone, nil
 	}
 
-	endpoint := fmt.Sprintf("%s/computeMetadata/v1/instance/id", metadataEndpoint)
+	endpoint := fmt.Sprintf("%s/computeMetadata/v1/instance/zone", e.MetadataEndpoint)
 
-	data, err := metadataRequest(endpoint)
+	data, err := e.metadataRequest(ctx, endpoint)
 	if err != nil {
 		return "", err
 	}
 
-	runtimeID = string(data)
-	return runtimeID, nil
+	e.zone = path.Base(string(data))
+	return e.zone, nil
+}
+
+// ServiceAccountEmail returns the email address of the default service
+// account.
+func ServiceAccountEmail() (string, error) {
+	return DefaultEnvironment.ServiceAccountEmail(context.Background())
+}
+
+// ServiceAccountEmailContext is like ServiceAccountEmail but uses the
+// given context.
+func ServiceAccountEmailContext(ctx context.Context) (string, error) {
+	return DefaultEnvironment.ServiceAccountEmail(ctx)
+}
+
+// ServiceAccountEmail returns the email address of the default service
+// account.
+func (e *Environment) ServiceAccountEmail(ctx context.Context) (string, error) {
+	return e.Metadata(ctx, "instance/service-accounts/default/email")
+}
+
+// ServiceAccounts returns the service accounts attached to the
+// container instance, sorted by email.
+func ServiceAccounts() ([]ServiceAccount, error) {
+	return DefaultEnvironment.ServiceAccounts(context.Background())
+}
+
+// ServiceAccountsContext is like ServiceAccounts but uses the given
+// context.
+func ServiceAccountsContext(ctx context.Context) ([]ServiceAccount, error) {
+	return DefaultEnvironment.ServiceAccounts(ctx)
+}
+
+// ServiceAccounts returns the service accounts attached to the
+// container instance, sorted by email.
+func (e *Environment) ServiceAccounts(ctx context.Context) ([]ServiceAccount, error) {
+	var accounts map[string]ServiceAccount
+	if err := e.MetadataRecursive(ctx, "instance/service-accounts/", &accounts); err != nil {
+		return nil, err
+	}
+
+	// The metadata server lists each account under its email and
+	// under every alias, so collapse the entries by email.
+	seen := make(map[string]bool)
+	serviceAccounts := make([]ServiceAccount, 0, len(accounts))
+	for _, account := range accounts {
+		if seen[account.Email] {
+			continue
+		}
+		seen[account.Email] = true
+		serviceAccounts = append(serviceAccounts, account)
+	}
+
+	sort.Slice(serviceAccounts, func(i, j int) bool {
+		return serviceAccounts[i].Email < serviceAccounts[j].Email
+	})
+
+	return serviceAccounts, nil
+}
+
+// ProjectAttributes returns the custom metadata attributes set on the
+// project.
+func ProjectAttributes() (map[string]string, error) {
+	return DefaultEnvironment.ProjectAttributes(context.Background())
+}
+
+// ProjectAttributesContext is like ProjectAttributes but uses the
+// given context.
+func ProjectAttributesContext(ctx context.Context) (map[string]string, error) {
+	return DefaultEnvironment.ProjectAttributes(ctx)
+}
+
+// ProjectAttributes returns the custom metadata attributes set on the
+// project.
+func (e *Environment) ProjectAttributes(ctx context.Context) (map[string]string, error) {
+	attributes := make(map[string]string)
+	if err := e.MetadataRecursive(ctx, "project/attributes/", &attributes); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+// ProjectAttribute returns the value of the named project metadata
+// attribute. ErrMetadataNotFound is returned if the attribute is not
+// set.
+func ProjectAttribute(name string) (string, error) {
+	return DefaultEnvironment.ProjectAttribute(context.Background(), name)
+}
+
+// ProjectAttributeContext is like ProjectAttribute but uses the given
+// context.
+func ProjectAttributeContext(ctx context.Context, name string) (string, error) {
+	return DefaultEnvironment.ProjectAttribute(ctx, name)
 }
 
-func metadataRequest(endpoint string) ([]byte, error) {
-	request, err := http.NewRequest("GET", endpoint, nil)
+// ProjectAttribute returns the value of the named project metadata
+// attribute. ErrMetadataNotFound is returned if the attribute is not
+// set.
+func (e *Environment) ProjectAttribute(ctx context.Context, name string) (string, error) {
+	return e.Metadata(ctx, "project/attributes/"+name)
+}
+
+// Metadata returns the value of the given metadata key, relative to
+// the computeMetadata/v1 path of the metadata server. For example
+// "instance/zone" or "project/attributes/env".
+func Metadata(key string) (string, error) {
+	return DefaultEnvironment.Metadata(context.Background(), key)
+}
+
+// MetadataContext is like Metadata but uses the given context.
+func MetadataContext(ctx context.Context, key string) (string, error) {
+	return DefaultEnvironment.Metadata(ctx, key)
+}
+
+// Metadata returns the value of the given metadata key, relative to
+// the computeMetadata/v1 path of the metadata server.
+func (e *Environment) Metadata(ctx context.Context, key string) (string, error) {
+	data, err := e.metadataRequest(ctx, e.metadataURL(key))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// MetadataRecursive fetches the given metadata directory and all of
+// its contents, and decodes the JSON response into v.
+func MetadataRecursive(key string, v interface{}) error {
+	return DefaultEnvironment.MetadataRecursive(context.Background(), key, v)
+}
+
+// MetadataRecursiveContext is like MetadataRecursive but uses the
+// given context.
+func MetadataRecursiveContext(ctx context.Context, key string, v interface{}) error {
+	return DefaultEnvironment.MetadataRecursive(ctx, key, v)
+}
+
+// MetadataRecursive fetches the given metadata directory and all of
+// its contents, and decodes the JSON response into v.
+func (e *Environment) MetadataRecursive(ctx context.Context, key string, v interface{}) error {
+	data, err := e.metadataRequest(ctx, e.metadataURL(key)+"?recursive=true")
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("run/metadata: error decoding %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (e *Environment) metadataURL(key string) string {
+	return fmt.Sprintf("%s/computeMetadata/v1/%s", e.MetadataEndpoint, strings.TrimPrefix(key, "/"))
+}
+
+// A metadataResponse holds the body and ETag of a metadata server
+// response.
+type metadataResponse struct {
+	data []byte
+	etag string
+}
+
+// metadataRequest calls the metadata server, retrying transient
+// errors with exponential backoff.
+func (e *Environment) metadataRequest(ctx context.Context, endpoint string) ([]byte, error) {
+	response, err := e.metadataGet(ctx, endpoint, e.metadataTimeout())
+	if err != nil {
+		return nil, err
+	}
+	return response.data, nil
+}
+
+// metadataGet is like metadataRequest but bounds each attempt by the
+// given timeout and returns the response ETag.
+func (e *Environment) metadataGet(ctx context.Context, endpoint string, timeout time.Duration) (*metadataResponse, error) {
+	for attempt := 0; ; attempt++ {
+		response, err := e.metadataAttempt(ctx, endpoint, timeout)
+		if err == nil || attempt >= e.MetadataRetries || !retryableMetadataError(err) {
+			return response, err
+		}
+
+		timer := time.NewTimer(e.metadataBackoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// retryableMetadataError reports whether a failed metadata server
+// request may succeed if retried.
+func retryableMetadataError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var e *ErrMetadataUnexpectedResponse
+	if errors.As(err, &e) {
+		return e.StatusCode == 429 || e.StatusCode >= 500
+	}
+
+	// The metadata server host does not resolve outside Google Cloud,
+	// so the fallback sources can be used right away.
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+
+	return !errors.Is(err, ErrMetadataNotFound) && !errors.Is(err, ErrMetadataInvalidRequest)
+}
+
+func (e *Environment) metadataAttempt(ctx context.Context, endpoint string, timeout time.Duration) (*metadataResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -172,10 +613,7 @@ func metadataRequest(endpoint string) ([]byte, error) {
 	request.Header.Set("User-Agent", userAgent)
 	request.Header.Add("Metadata-Flavor", "Google")
 
-	timeout := time.Duration(5) * time.Second
-	httpClient := http.Client{Timeout: timeout}
-
-	response, err := httpClient.Do(request)
+	response, err := e.httpClient().Do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -197,5 +635,5 @@ func metadataRequest(endpoint string) ([]byte, error) {
 		return nil, err
 	}
 
-	return data, nil
+	return &metadataResponse{data: data, etag: response.Header.Get("ETag")}, nil
 }
@@ -1,11 +1,16 @@
 package run
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/kelseyhightower/run/internal/gcptest"
 )
@@ -20,6 +25,10 @@ var metadataTests = []struct {
 	{"projectid", gcptest.ProjectID, nil},
 	{"numericprojectid", gcptest.NumericProjectID, nil},
 	{"region", gcptest.Region, nil},
+	{"zone", gcptest.Zone, nil},
+	{"serviceaccountemail", gcptest.ServiceAccountEmail, nil},
+	{"projectattribute", "test", nil},
+	{"missingprojectattribute", "", ErrMetadataNotFound},
 	{"notfound", "", ErrMetadataNotFound},
 	{"invalid", "", ErrMetadataInvalidRequest},
 	{"unknown", "", ErrMetadataUnknownError},
@@ -29,7 +38,7 @@ func TestMetadata(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
 	defer ts.Close()
 
-	metadataEndpoint = ts.URL
+	DefaultEnvironment.MetadataEndpoint = ts.URL
 
 	v, err := Token([]string{"https://www.googleapis.com/auth/cloud-platform"})
 	if !errors.Is(err, nil) {
@@ -57,6 +66,14 @@ func TestMetadata(t *testing.T) {
 			v, err = NumericProjectID()
 		case "region":
 			v, err = Region()
+		case "zone":
+			v, err = Zone()
+		case "serviceaccountemail":
+			v, err = ServiceAccountEmail()
+		case "projectattribute":
+			v, err = ProjectAttribute("env")
+		case "missingprojectattribute":
+			v, err = ProjectAttribute("missing")
 		default:
 			v, err = errorMetadataRequest(tt.name)
 		}
@@ -89,7 +106,7 @@ func TestMetadataErrors(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(gcptest.BrokenMetadataHandler))
 	defer ts.Close()
 
-	metadataEndpoint = ts.URL
+	DefaultEnvironment.MetadataEndpoint = ts.URL
 
 	v, err := Token([]string{"https://www.googleapis.com/auth/cloud-platform"})
 	if errors.Is(err, nil) {
@@ -130,17 +147,258 @@ func TestMetadataErrors(t *testing.T) {
 }
 
 func resetRuntimeMetadata() {
-	rmu.Lock()
-	defer rmu.Unlock()
+	e := DefaultEnvironment
 
-	runtimeID = ""
-	runtimeProjectID = ""
-	runtimeRegion = ""
-	runtimeNumericProjectID = ""
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.id = ""
+	e.projectID = ""
+	e.region = ""
+	e.numericProjectID = ""
+	e.zone = ""
+
+	e.accessTokens = newTokenCache(accessTokenRefreshAhead, e.fetchToken)
 }
 
 func errorMetadataRequest(key string) (string, error) {
-	endpoint := fmt.Sprintf("%s/computeMetadata/v1/%s", metadataEndpoint, key)
-	v, err := metadataRequest(endpoint)
+	endpoint := fmt.Sprintf("%s/computeMetadata/v1/%s", DefaultEnvironment.MetadataEndpoint, key)
+	v, err := DefaultEnvironment.metadataRequest(context.Background(), endpoint)
 	return string(v), err
 }
+
+func TestMetadataContext(t *testing.T) {
+	resetRuntimeMetadata()
+
+	ts := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ts.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ts.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := ProjectIDContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error, want %q, got %q", context.Canceled, err)
+	}
+
+	if _, err := TokenContext(ctx, []string{"https://www.googleapis.com/auth/cloud-platform"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error, want %q, got %q", context.Canceled, err)
+	}
+
+	v, err := ProjectIDContext(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if v != gcptest.ProjectID {
+		t.Errorf("want %v, got %v", gcptest.ProjectID, v)
+	}
+}
+
+var metadataRetryTests = []struct {
+	name     string
+	failures int32
+	status   int
+	want     int32
+	err      error
+}{
+	{"recovers", 2, 503, 3, nil},
+	{"rate limited", 1, 429, 2, nil},
+	{"exhausted", 10, 500, 4, ErrMetadataUnknownError},
+	{"not found", 10, 404, 1, ErrMetadataNotFound},
+	{"invalid", 10, 400, 1, ErrMetadataInvalidRequest},
+}
+
+func TestMetadataRetry(t *testing.T) {
+	for _, tt := range metadataRetryTests {
+		var requests int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&requests, 1) <= tt.failures {
+				http.Error(w, "", tt.status)
+				return
+			}
+			gcptest.MetadataHandler(w, r)
+		}))
+
+		e := NewEnvironment()
+		e.MetadataEndpoint = ts.URL
+		e.MetadataBackoff = time.Millisecond
+
+		v, err := e.ProjectID(context.Background())
+		ts.Close()
+
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: unexpected error, want %q, got %q", tt.name, tt.err, err)
+		}
+
+		if err == nil && v != gcptest.ProjectID {
+			t.Errorf("%s: want %v, got %v", tt.name, gcptest.ProjectID, v)
+		}
+
+		if n := atomic.LoadInt32(&requests); n != tt.want {
+			t.Errorf("%s: request count mismatch; want %d, got %d", tt.name, tt.want, n)
+		}
+	}
+}
+
+func TestMetadataRetryConnectionRefused(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	endpoint := ts.URL
+	ts.Close()
+
+	var attempts int32
+	e := NewEnvironment()
+	e.MetadataEndpoint = endpoint
+	e.MetadataBackoff = time.Millisecond
+	e.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&attempts, 1)
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}
+
+	if _, err := e.ID(context.Background()); err == nil {
+		t.Error("expected connection error")
+	}
+
+	if n := atomic.LoadInt32(&attempts); n != 4 {
+		t.Errorf("attempt count mismatch; want 4, got %d", n)
+	}
+}
+
+func TestMetadataNoRetryHostNotFound(t *testing.T) {
+	var attempts int32
+	e := NewEnvironment()
+	e.MetadataBackoff = time.Millisecond
+	e.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&attempts, 1)
+			return nil, &net.DNSError{Err: "no such host", Name: r.URL.Hostname(), IsNotFound: true}
+		}),
+	}
+
+	if _, err := e.ID(context.Background()); err == nil {
+		t.Error("expected host not found error")
+	}
+
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("attempt count mismatch; want 1, got %d", n)
+	}
+}
+
+func TestMetadataBackoff(t *testing.T) {
+	e := NewEnvironment()
+
+	for attempt := 0; attempt < 10; attempt++ {
+		d := e.metadataBackoff(attempt)
+		if d < defaultMetadataBackoff/2 || d > defaultMetadataMaxBackoff {
+			t.Errorf("attempt %d: backoff %v out of range", attempt, d)
+		}
+	}
+}
+
+func TestServiceAccounts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ts.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ts.URL
+
+	accounts, err := ServiceAccounts()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(accounts) != 2 {
+		t.Fatalf("want 2 service accounts, got %d", len(accounts))
+	}
+
+	if accounts[0].Email != gcptest.BackendAccountEmail {
+		t.Errorf("want %v, got %v", gcptest.BackendAccountEmail, accounts[0].Email)
+	}
+
+	if accounts[1].Email != gcptest.ServiceAccountEmail {
+		t.Errorf("want %v, got %v", gcptest.ServiceAccountEmail, accounts[1].Email)
+	}
+
+	if len(accounts[1].Scopes) != 1 || accounts[1].Scopes[0] != "https://www.googleapis.com/auth/cloud-platform" {
+		t.Errorf("unexpected scopes: %v", accounts[1].Scopes)
+	}
+}
+
+func TestProjectAttributes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ts.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ts.URL
+
+	attributes, err := ProjectAttributes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(attributes, gcptest.ProjectAttributes) {
+		t.Errorf("want %v, got %v", gcptest.ProjectAttributes, attributes)
+	}
+}
+
+func TestMetadataRecursive(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ts.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ts.URL
+
+	var attributes map[string]string
+	if err := MetadataRecursive("/project/attributes/", &attributes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if attributes["env"] != "test" {
+		t.Errorf("want %v, got %v", "test", attributes["env"])
+	}
+
+	v, err := Metadata("instance/id")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if v != gcptest.ID {
+		t.Errorf("want %v, got %v", gcptest.ID, v)
+	}
+
+	if err := MetadataRecursive("notfound", &attributes); !errors.Is(err, ErrMetadataNotFound) {
+		t.Errorf("unexpected error, want %q, got %q", ErrMetadataNotFound, err)
+	}
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ts.Close()
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ts.URL
+
+	ctx := context.Background()
+	scopes := []string{"https://www.googleapis.com/auth/cloud-platform"}
+
+	token, err := e.ServiceAccountToken(ctx, gcptest.BackendAccountEmail, scopes)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if token.AccessToken != gcptest.AccessToken.AccessToken {
+		t.Errorf("want %v, got %v", gcptest.AccessToken.AccessToken, token.AccessToken)
+	}
+
+	idToken, err := e.ServiceAccountIDToken(ctx, gcptest.BackendAccountEmail, "https://test-0123456789-ue.a.run.app")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if idToken != gcptest.IDToken {
+		t.Errorf("want %v, got %v", gcptest.IDToken, idToken)
+	}
+
+	_, err = e.ServiceAccountToken(ctx, "missing@test.iam.gserviceaccount.com", scopes)
+	if !errors.Is(err, ErrMetadataNotFound) {
+		t.Errorf("unexpected error, want %q, got %q", ErrMetadataNotFound, err)
+	}
+}
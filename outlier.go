@@ -0,0 +1,237 @@
+package run
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConsecutiveFailures = 5
+	defaultBaseEjectionTime    = 30 * time.Second
+	defaultMaxEjectionTime     = 5 * time.Minute
+	outlierProbeTimeout        = 5 * time.Second
+)
+
+// OutlierDetection configures passive outlier detection in Transport.
+//
+// Endpoints that return consecutive connection errors or HTTP 5xx
+// responses are ejected from load balancing. Once the ejection time has
+// passed the endpoint is probed, and it receives requests again only if
+// the probe succeeds. Each further ejection doubles the ejection time.
+// If every endpoint of a service is ejected, requests are sent to all
+// of them.
+type OutlierDetection struct {
+	// ConsecutiveFailures is the number of consecutive connection errors
+	// or 5xx responses after which an endpoint is ejected. If zero, 5
+	// is used.
+	ConsecutiveFailures int
+
+	// BaseEjectionTime is how long an endpoint is ejected for the first
+	// time. If zero, 30 seconds is used.
+	BaseEjectionTime time.Duration
+
+	// MaxEjectionTime caps the ejection time. If zero, 5 minutes is
+	// used.
+	MaxEjectionTime time.Duration
+
+	// Probe checks whether an ejected endpoint has recovered. If nil, a
+	// TCP connection to the endpoint is attempted.
+	Probe func(ctx context.Context, endpoint Endpoint) error
+}
+
+func (o *OutlierDetection) consecutiveFailures() int {
+	if o.ConsecutiveFailures <= 0 {
+		return defaultConsecutiveFailures
+	}
+	return o.ConsecutiveFailures
+}
+
+// ejectionTime returns how long an endpoint that has already been
+// ejected the given number of times is ejected for.
+func (o *OutlierDetection) ejectionTime(ejections int) time.Duration {
+	d := o.BaseEjectionTime
+	if d <= 0 {
+		d = defaultBaseEjectionTime
+	}
+
+	max := o.MaxEjectionTime
+	if max <= 0 {
+		max = defaultMaxEjectionTime
+	}
+
+	for i := 0; i < ejections && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (o *OutlierDetection) probe(ctx context.Context, endpoint Endpoint) error {
+	if o.Probe != nil {
+		return o.Probe(ctx, endpoint)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(endpoint.Address, strconv.Itoa(endpoint.Port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// An outlierDetector tracks the health of a service's endpoints. It is
+// safe for concurrent use.
+type outlierDetector struct {
+	config *OutlierDetection
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// onChange is called, without mu held, after an endpoint is
+	// ejected or re-admitted.
+	onChange func()
+
+	mu        sync.Mutex
+	endpoints map[string]*endpointHealth
+}
+
+type endpointHealth struct {
+	failures  int
+	ejections int
+	ejected   bool
+	timer     *time.Timer
+}
+
+func newOutlierDetector(config *OutlierDetection, onChange func()) *outlierDetector {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &outlierDetector{
+		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
+		onChange:  onChange,
+		endpoints: make(map[string]*endpointHealth),
+	}
+}
+
+// ejected reports whether endpoint is currently ejected.
+func (d *outlierDetector) ejected(endpoint Endpoint) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	h, ok := d.endpoints[endpointKey(endpoint)]
+	return ok && h.ejected
+}
+
+// record records the outcome of a request to endpoint, ejecting it
+// after too many consecutive failures.
+func (d *outlierDetector) record(endpoint Endpoint, failed bool) {
+	d.mu.Lock()
+
+	key := endpointKey(endpoint)
+	h, ok := d.endpoints[key]
+	if !ok {
+		h = &endpointHealth{}
+		d.endpoints[key] = h
+	}
+
+	if !failed {
+		h.failures = 0
+		if !h.ejected {
+			h.ejections = 0
+		}
+		d.mu.Unlock()
+		return
+	}
+
+	h.failures++
+	if h.ejected || h.failures < d.config.consecutiveFailures() {
+		d.mu.Unlock()
+		return
+	}
+
+	h.ejected = true
+	h.failures = 0
+	d.eject(endpoint, h)
+	d.mu.Unlock()
+
+	d.onChange()
+}
+
+// eject schedules a probe of endpoint once its ejection time has
+// passed. d.mu must be held.
+func (d *outlierDetector) eject(endpoint Endpoint, h *endpointHealth) {
+	if d.ctx.Err() != nil {
+		return
+	}
+
+	h.timer = time.AfterFunc(d.config.ejectionTime(h.ejections), func() { d.probe(endpoint) })
+	h.ejections++
+}
+
+// probe re-admits endpoint if it has recovered, or ejects it again.
+func (d *outlierDetector) probe(endpoint Endpoint) {
+	ctx, cancel := context.WithTimeout(d.ctx, outlierProbeTimeout)
+	err := d.config.probe(ctx, endpoint)
+	cancel()
+
+	d.mu.Lock()
+
+	h, ok := d.endpoints[endpointKey(endpoint)]
+	if !ok || d.ctx.Err() != nil {
+		d.mu.Unlock()
+		return
+	}
+
+	if err != nil {
+		d.eject(endpoint, h)
+		d.mu.Unlock()
+		return
+	}
+
+	h.ejected = false
+	d.mu.Unlock()
+
+	d.onChange()
+}
+
+// retain discards the health of endpoints not in the given list,
+// stopping any pending probes.
+func (d *outlierDetector) retain(endpoints []Endpoint) {
+	keep := make(map[string]bool, len(endpoints))
+	for _, endpoint := range endpoints {
+		keep[endpointKey(endpoint)] = true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, h := range d.endpoints {
+		if keep[key] {
+			continue
+		}
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+		delete(d.endpoints, key)
+	}
+}
+
+// close stops all pending probes.
+func (d *outlierDetector) close() {
+	d.cancel()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, h := range d.endpoints {
+		if h.timer != nil {
+			h.timer.Stop()
+		}
+	}
+}
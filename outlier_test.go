@@ -0,0 +1,252 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+func TestOutlierDetectionEjectionTime(t *testing.T) {
+	o := &OutlierDetection{
+		BaseEjectionTime: time.Second,
+		MaxEjectionTime:  5 * time.Second,
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := o.ejectionTime(i); got != w {
+			t.Errorf("ejection %d time mismatch; want %v, got %v", i, w, got)
+		}
+	}
+}
+
+func TestOutlierDetector(t *testing.T) {
+	var changes int32
+	var healthy atomic.Value
+	healthy.Store(false)
+
+	config := &OutlierDetection{
+		ConsecutiveFailures: 3,
+		BaseEjectionTime:    10 * time.Millisecond,
+		Probe: func(ctx context.Context, endpoint Endpoint) error {
+			if !healthy.Load().(bool) {
+				return errors.New("unhealthy")
+			}
+			return nil
+		},
+	}
+
+	d := newOutlierDetector(config, func() { atomic.AddInt32(&changes, 1) })
+	defer d.close()
+
+	endpoint := Endpoint{Name: "test-10-0-0-1", Address: "10.0.0.1", Port: 8080}
+
+	d.record(endpoint, true)
+	d.record(endpoint, true)
+	d.record(endpoint, false)
+	d.record(endpoint, true)
+	d.record(endpoint, true)
+	if d.ejected(endpoint) {
+		t.Fatal("endpoint ejected before consecutive failure threshold")
+	}
+
+	d.record(endpoint, true)
+	if !d.ejected(endpoint) {
+		t.Fatal("endpoint not ejected after consecutive failures")
+	}
+
+	// Failed probes keep the endpoint ejected.
+	time.Sleep(50 * time.Millisecond)
+	if !d.ejected(endpoint) {
+		t.Fatal("endpoint re-admitted after failed probe")
+	}
+
+	healthy.Store(true)
+
+	deadline := time.Now().Add(time.Second)
+	for d.ejected(endpoint) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if d.ejected(endpoint) {
+		t.Fatal("endpoint not re-admitted after successful probe")
+	}
+
+	if n := atomic.LoadInt32(&changes); n != 2 {
+		t.Errorf("change count mismatch; want 2, got %d", n)
+	}
+}
+
+func TestOutlierDetectorRetain(t *testing.T) {
+	config := &OutlierDetection{ConsecutiveFailures: 1, BaseEjectionTime: time.Hour}
+
+	d := newOutlierDetector(config, func() {})
+	defer d.close()
+
+	removed := Endpoint{Name: "test-10-0-0-1", Address: "10.0.0.1", Port: 8080}
+	kept := Endpoint{Name: "test-10-0-0-2", Address: "10.0.0.2", Port: 8080}
+
+	d.record(removed, true)
+	d.record(kept, true)
+
+	d.mu.Lock()
+	timer := d.endpoints[endpointKey(removed)].timer
+	d.mu.Unlock()
+
+	d.retain([]Endpoint{kept})
+
+	if d.ejected(removed) {
+		t.Error("expected health of removed endpoint to be discarded")
+	}
+	if !d.ejected(kept) {
+		t.Error("expected retained endpoint to stay ejected")
+	}
+	if timer.Stop() {
+		t.Error("expected probe of removed endpoint to be stopped")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if n := len(d.endpoints); n != 1 {
+		t.Errorf("endpoint count mismatch; want 1, got %d", n)
+	}
+}
+
+func TestTransportOutlierDetection(t *testing.T) {
+	var failing atomic.Value
+	failing.Store(true)
+
+	var badHits, goodHits int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&badHits, 1)
+		if failing.Load().(bool) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer bad.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goodHits, 1)
+	}))
+	defer good.Close()
+
+	tr := &Transport{
+		Environment: balancerEnvironment(t, []gcptest.Endpoint{testEndpoint(t, bad), testEndpoint(t, good)}),
+		OutlierDetection: &OutlierDetection{
+			ConsecutiveFailures: 2,
+			BaseEjectionTime:    20 * time.Millisecond,
+			MaxEjectionTime:     20 * time.Millisecond,
+			Probe: func(ctx context.Context, endpoint Endpoint) error {
+				if failing.Load().(bool) {
+					return errors.New("unhealthy")
+				}
+				return nil
+			},
+		},
+	}
+	defer tr.Close()
+
+	httpClient := &http.Client{Transport: tr}
+
+	get := func() {
+		t.Helper()
+
+		response, err := httpClient.Get("http://test.test.run.local/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	for i := 0; i < 20; i++ {
+		get()
+	}
+
+	if n := atomic.LoadInt32(&badHits); n != 2 {
+		t.Errorf("failing backend request count mismatch; want 2, got %d", n)
+	}
+	if n := atomic.LoadInt32(&goodHits); n != 18 {
+		t.Errorf("healthy backend request count mismatch; want 18, got %d", n)
+	}
+
+	failing.Store(false)
+	time.Sleep(100 * time.Millisecond)
+
+	atomic.StoreInt32(&badHits, 0)
+	for i := 0; i < 10; i++ {
+		get()
+	}
+
+	if n := atomic.LoadInt32(&badHits); n != 5 {
+		t.Errorf("recovered backend request count mismatch; want 5, got %d", n)
+	}
+}
+
+func TestTransportOutlierDetectionIgnoresAuthErrors(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer ts.Close()
+
+	endpoint := testEndpoint(t, ts)
+	e := balancerEnvironment(t, []gcptest.Endpoint{endpoint})
+
+	// Fail ID token requests only, so discovery still works.
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/identity") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		gcptest.MetadataHandler(w, r)
+	}))
+	defer ms.Close()
+
+	e.MetadataEndpoint = ms.URL
+	e.MetadataRetries = 0
+
+	var retries int32
+	tr := &Transport{
+		Environment:      e,
+		InjectAuthHeader: true,
+		OutlierDetection: &OutlierDetection{ConsecutiveFailures: 1},
+		Retry: &RetryPolicy{
+			OnRetry: func(r *http.Request, attempts int, response *http.Response, err error) {
+				atomic.AddInt32(&retries, 1)
+			},
+		},
+	}
+	defer tr.Close()
+
+	_, err := (&http.Client{Transport: tr}).Get("http://test.test.run.local/")
+	if err == nil {
+		t.Fatal("expected error fetching ID token")
+	}
+
+	var authErr *authHeaderError
+	if errors.As(err, &authErr) {
+		t.Error("auth header error returned to caller without unwrapping")
+	}
+
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("backend request count mismatch; want 0, got %d", n)
+	}
+	if n := atomic.LoadInt32(&retries); n != 0 {
+		t.Errorf("retry count mismatch; want 0, got %d", n)
+	}
+
+	tr.mu.Lock()
+	entry := tr.balancers["test.test"]
+	tr.mu.Unlock()
+
+	if entry.outliers.ejected(Endpoint{Name: endpoint.Name}) {
+		t.Error("endpoint ejected after auth header error")
+	}
+}
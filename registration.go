@@ -0,0 +1,103 @@
+package run
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultRegistrationInterval = 5 * time.Minute
+	readinessPollInterval       = time.Second
+)
+
+// A ServeOption configures ListenAndServe.
+type ServeOption func(*serveConfig)
+
+type serveConfig struct {
+	registration *Registration
+}
+
+// A Registration configures self-registration of the running instance
+// in Service Directory by ListenAndServe.
+type Registration struct {
+	// Namespace is the Service Directory namespace the instance is
+	// registered in, as an endpoint of the current Cloud Run service.
+	Namespace string
+
+	// Readiness optionally delays registration until its Ready method
+	// returns true. If nil, the instance is registered as soon as the
+	// server is listening.
+	Readiness Probe
+
+	// Interval is how often the registration, including its
+	// heartbeat, is refreshed and restored if it has been removed. If
+	// zero, 5 minutes is used.
+	Interval time.Duration
+
+	// Environment optionally provides the Environment used to call
+	// Service Directory. If nil, DefaultEnvironment is used.
+	Environment *Environment
+}
+
+// WithRegistration registers the running instance in Service Directory
+// once the server is listening and ready, keeps it registered while the
+// server runs, and deregisters it on shutdown before active connections
+// are drained.
+func WithRegistration(registration Registration) ServeOption {
+	return func(c *serveConfig) {
+		c.registration = &registration
+	}
+}
+
+func (reg *Registration) environment() *Environment {
+	if reg.Environment != nil {
+		return reg.Environment
+	}
+	return DefaultEnvironment
+}
+
+func (reg *Registration) interval() time.Duration {
+	if reg.Interval <= 0 {
+		return defaultRegistrationInterval
+	}
+	return reg.Interval
+}
+
+// run waits for readiness, registers the instance, and re-asserts the
+// registration until ctx is done. It reports whether the instance was
+// registered at least once.
+func (reg *Registration) run(ctx context.Context) bool {
+	if reg.Readiness != nil {
+		ticker := time.NewTicker(readinessPollInterval)
+		defer ticker.Stop()
+
+		for !reg.Readiness.Ready() {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+
+	registered := false
+	for {
+		// RegisterEndpoint logs its own errors.
+		if err := reg.assert(ctx); err == nil {
+			registered = true
+		}
+
+		select {
+		case <-time.After(reg.interval()):
+		case <-ctx.Done():
+			return registered
+		}
+	}
+}
+
+// assert registers the instance, updating the existing endpoint if it
+// is already registered.
+func (reg *Registration) assert(ctx context.Context) error {
+	_, err := reg.environment().registerEndpoint(ctx, reg.Namespace, true)
+	return err
+}
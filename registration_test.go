@@ -0,0 +1,133 @@
+package run
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+type flagProbe struct {
+	ready int32
+}
+
+func (p *flagProbe) Ready() bool { return atomic.LoadInt32(&p.ready) == 1 }
+
+// registrationEnvironment configures the running instance as the
+// "registered" service at 10.0.0.1:8080 and returns an Environment
+// whose Service Directory holds the service in the "test" namespace.
+func registrationEnvironment(t *testing.T) (*Environment, *gcptest.ServiceDirectory) {
+	t.Helper()
+
+	t.Setenv("K_SERVICE", "registered")
+	t.Setenv("PORT", "8080")
+
+	ip := instanceIPAddress
+	instanceIPAddress = func() (string, error) { return "10.0.0.1", nil }
+	t.Cleanup(func() { instanceIPAddress = ip })
+
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "registered", nil)
+
+	return serviceDirectoryEnvironment(t, sd), sd
+}
+
+// waitForEndpoints waits until the registered service has n endpoints.
+func waitForEndpoints(t *testing.T, sd *gcptest.ServiceDirectory, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sd.Endpoints("test", "registered")) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("endpoint count mismatch; want %d, got %d", n, len(sd.Endpoints("test", "registered")))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeRegistration(t *testing.T) {
+	e, sd := registrationEnvironment(t)
+
+	probe := &flagProbe{}
+	config := &serveConfig{}
+	WithRegistration(Registration{
+		Namespace:   "test",
+		Readiness:   probe,
+		Interval:    50 * time.Millisecond,
+		Environment: e,
+	})(config)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	shutdown := make(chan os.Signal, 1)
+
+	errc := make(chan error, 1)
+	go func() { errc <- serve(server, ln, config, shutdown) }()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := len(sd.Endpoints("test", "registered")); n != 0 {
+		t.Fatalf("endpoint registered before readiness; got %d endpoints", n)
+	}
+
+	atomic.StoreInt32(&probe.ready, 1)
+	waitForEndpoints(t, sd, 1)
+
+	endpoint := sd.Endpoints("test", "registered")[0]
+	if endpoint.Address != "10.0.0.1" || endpoint.Port != 8080 {
+		t.Errorf("endpoint mismatch; got %+v", endpoint)
+	}
+	if _, err := time.Parse(time.RFC3339, endpoint.Annotations[HeartbeatAnnotation]); err != nil {
+		t.Errorf("invalid heartbeat annotation: %v", err)
+	}
+
+	// A removed registration is restored.
+	sd.SetEndpoints("test", "registered", nil)
+	waitForEndpoints(t, sd, 1)
+
+	shutdown <- os.Interrupt
+
+	select {
+	case err := <-errc:
+		if err != http.ErrServerClosed {
+			t.Errorf("error mismatch; want %v, got %v", http.ErrServerClosed, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not shut down")
+	}
+
+	if n := len(sd.Endpoints("test", "registered")); n != 0 {
+		t.Errorf("endpoint count after shutdown mismatch; want 0, got %d", n)
+	}
+}
+
+func TestServeWithoutRegistration(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	shutdown := make(chan os.Signal, 1)
+
+	errc := make(chan error, 1)
+	go func() { errc <- serve(server, ln, &serveConfig{}, shutdown) }()
+
+	response, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	shutdown <- os.Interrupt
+	if err := <-errc; err != http.ErrServerClosed {
+		t.Errorf("error mismatch; want %v, got %v", http.ErrServerClosed, err)
+	}
+}
@@ -0,0 +1,137 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultServiceNameTTL = 5 * time.Minute
+
+var (
+	serviceNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+	regionRegexp      = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+$`)
+	projectRegexp     = regexp.MustCompile(`^[a-z][-a-z0-9]{4,28}[a-z0-9]$`)
+)
+
+// serviceName identifies a Cloud Run service. Empty Region and Project
+// fields default to those of the running instance.
+type serviceName struct {
+	Name    string
+	Region  string
+	Project string
+}
+
+// parseServiceName parses a host of the form name, name.region, or
+// name.region.project. It reports false for hosts that cannot be a
+// Cloud Run service name, such as DNS names and IP addresses.
+func parseServiceName(host string) (serviceName, bool) {
+	var s serviceName
+
+	ss := strings.Split(host, ".")
+	if len(ss) > 3 {
+		return s, false
+	}
+
+	s.Name = ss[0]
+	if !serviceNameRegexp.MatchString(s.Name) {
+		return s, false
+	}
+
+	if len(ss) > 1 {
+		s.Region = ss[1]
+		if !regionRegexp.MatchString(s.Region) {
+			return s, false
+		}
+	}
+
+	if len(ss) > 2 {
+		s.Project = ss[2]
+		if !projectRegexp.MatchString(s.Project) {
+			return s, false
+		}
+	}
+
+	return s, true
+}
+
+// serviceURLCache caches Cloud Run service URLs by service name.
+type serviceURLCache struct {
+	mu      sync.Mutex
+	entries map[serviceName]serviceURLEntry
+}
+
+type serviceURLEntry struct {
+	url     *url.URL
+	expires time.Time
+}
+
+func (c *serviceURLCache) get(s serviceName) (*url.URL, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[s]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.url, true
+}
+
+func (c *serviceURLCache) set(s serviceName, u *url.URL, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[serviceName]serviceURLEntry)
+	}
+	c.entries[s] = serviceURLEntry{url: u, expires: time.Now().Add(ttl)}
+}
+
+func (t *Transport) serviceNameTTL() time.Duration {
+	if t.ServiceNameTTL <= 0 {
+		return defaultServiceNameTTL
+	}
+	return t.ServiceNameTTL
+}
+
+// serviceURL returns the URL of the named Cloud Run service, looking
+// it up with the Cloud Run API unless it is cached. Errors are not
+// cached.
+func (t *Transport) serviceURL(ctx context.Context, s serviceName) (*url.URL, error) {
+	if u, ok := t.serviceURLs.get(s); ok {
+		return u, nil
+	}
+
+	service, err := t.environment().getService(ctx, s.Name, s.Region, s.Project)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(service.Status.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("run: service %s has no URL", s.Name)
+	}
+
+	t.serviceURLs.set(s, u, t.serviceNameTTL())
+	return u, nil
+}
+
+// roundTripServiceName sends the request to the URL of the named Cloud
+// Run service with an ID token. If audience is empty, the service URL
+// is used.
+func (t *Transport) roundTripServiceName(r *http.Request, s serviceName, audience string) (*http.Response, error) {
+	u, err := t.serviceURL(r.Context(), s)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.roundTripTo(r, u, audience, true)
+}
@@ -0,0 +1,165 @@
+package run
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+func TestParseServiceName(t *testing.T) {
+	tests := []struct {
+		host string
+		want serviceName
+		ok   bool
+	}{
+		{"backend", serviceName{Name: "backend"}, true},
+		{"backend.us-central1", serviceName{Name: "backend", Region: "us-central1"}, true},
+		{"backend.us-central1.my-project", serviceName{"backend", "us-central1", "my-project"}, true},
+		{"example.com", serviceName{}, false},
+		{"api.example.com", serviceName{}, false},
+		{"backend.test.run.local", serviceName{}, false},
+		{"10.0.0.1", serviceName{}, false},
+		{"backend:8080", serviceName{}, false},
+		{"Backend", serviceName{}, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseServiceName(tt.host)
+		if ok != tt.ok {
+			t.Errorf("%s: ok mismatch; want %v, got %v", tt.host, tt.ok, ok)
+			continue
+		}
+		if ok && got != tt.want {
+			t.Errorf("%s: service name mismatch; want %+v, got %+v", tt.host, tt.want, got)
+		}
+	}
+}
+
+// serviceNameEnvironment returns an Environment whose Cloud Run API
+// serves the "backend" service at u, and records the paths requested.
+func serviceNameEnvironment(t *testing.T, cloudRunEndpoint, u string) (*Environment, func() []string) {
+	t.Helper()
+
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	t.Cleanup(ms.Close)
+
+	var mu sync.Mutex
+	var paths []string
+	cloudrun := gcptest.CloudrunServer(map[string]string{"backend": u})
+	cs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		cloudrun.ServeHTTP(w, r)
+	}))
+	t.Cleanup(cs.Close)
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+	e.CloudRunEndpoint = cs.URL + cloudRunEndpoint
+
+	return e, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func TestTransportServiceNameResolution(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+" "+r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+
+	e, lookups := serviceNameEnvironment(t, "", ts.URL)
+
+	tr := &Transport{
+		Environment:                 e,
+		EnableServiceNameResolution: true,
+	}
+	httpClient := &http.Client{Transport: tr}
+
+	for i := 0; i < 2; i++ {
+		response, err := httpClient.Get("https://backend/ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	}
+
+	want := "/ping Bearer " + gcptest.IDToken
+	if len(requests) != 2 || requests[0] != want || requests[1] != want {
+		t.Errorf("requests mismatch; want 2 x %q, got %q", want, requests)
+	}
+
+	if n := len(lookups()); n != 1 {
+		t.Errorf("service lookup count mismatch; want 1, got %d", n)
+	}
+
+	_, err := httpClient.Get("https://missing/")
+	if !errors.Is(err, ErrServiceNotFound) {
+		t.Errorf("error mismatch; want %v, got %v", ErrServiceNotFound, err)
+	}
+}
+
+func TestTransportServiceNameResolutionRegion(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	e, lookups := serviceNameEnvironment(t, "/%s", ts.URL)
+
+	tr := &Transport{Environment: e, EnableServiceNameResolution: true}
+
+	response, err := (&http.Client{Transport: tr}).Get("https://backend.europe-west1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	want := "/europe-west1/apis/serving.knative.dev/v1/namespaces/test/services/backend"
+	if paths := lookups(); len(paths) != 1 || paths[0] != want {
+		t.Errorf("service lookup mismatch; want %s, got %v", want, paths)
+	}
+}
+
+func TestTransportServiceNameResolutionDefaultNamespace(t *testing.T) {
+	DefaultNamespace = "test"
+	defer func() { DefaultNamespace = "" }()
+
+	var served bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true }))
+	defer ts.Close()
+
+	e, lookups := serviceNameEnvironment(t, "", ts.URL)
+
+	sd := gcptest.NewServiceDirectory()
+	sd.SetEndpoints("test", "backend", []gcptest.Endpoint{testEndpoint(t, ts)})
+
+	ss := httptest.NewServer(sd)
+	defer ss.Close()
+
+	e.ServiceDirectoryEndpoint = ss.URL
+
+	tr := &Transport{Environment: e, EnableServiceNameResolution: true}
+	defer tr.Close()
+
+	// A bare name is a Service Directory service in the default
+	// namespace.
+	response, err := (&http.Client{Transport: tr}).Get("http://backend/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if !served {
+		t.Error("expected request to be sent to the Service Directory endpoint")
+	}
+	if paths := lookups(); len(paths) != 0 {
+		t.Errorf("unexpected service lookups: %v", paths)
+	}
+}
@@ -0,0 +1,259 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AttemptsHeader is the response header in which Transport reports how
+// many attempts were made when retries are enabled.
+const AttemptsHeader = "X-Run-Attempts"
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryBudget   = 10
+	defaultRetryRefill   = 0.1
+)
+
+// A RetryPolicy configures how Transport retries requests to Service
+// Directory endpoints that fail with a connection error or an HTTP 502,
+// 503, or 504 response.
+//
+// Only requests with an idempotent method, or whose body can be
+// replayed using GetBody, are retried. Each retry is sent to a
+// different endpoint where possible.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts per request,
+	// including the first. If zero, 3 is used.
+	MaxAttempts int
+
+	// PerTryTimeout optionally bounds each attempt. The request's
+	// context bounds all attempts together.
+	PerTryTimeout time.Duration
+
+	// Budget is the maximum number of retry tokens. Each retry spends a
+	// token, and retries stop when none are left, so that a failing
+	// service is not flooded with retries. If zero, 10 is used.
+	Budget int
+
+	// BudgetRefill is the number of tokens returned to the budget by
+	// each successful attempt. If zero, 0.1 is used.
+	BudgetRefill float64
+
+	// OnRetry is optionally called before each retry with the number
+	// of attempts made so far and the failed attempt's response or
+	// error.
+	OnRetry func(r *http.Request, attempts int, response *http.Response, err error)
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return defaultRetryAttempts
+	}
+	return p.MaxAttempts
+}
+
+// retryBudget is a token bucket limiting retries. It is safe for
+// concurrent use.
+type retryBudget struct {
+	mu     sync.Mutex
+	init   bool
+	tokens float64
+}
+
+// withdraw spends a token if one is available.
+func (b *retryBudget) withdraw(p *RetryPolicy) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fill(p)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// deposit returns part of a token after a successful attempt.
+func (b *retryBudget) deposit(p *RetryPolicy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fill(p)
+
+	refill := p.BudgetRefill
+	if refill <= 0 {
+		refill = defaultRetryRefill
+	}
+
+	b.tokens += refill
+	if max := float64(retryBudgetMax(p)); b.tokens > max {
+		b.tokens = max
+	}
+}
+
+// fill fills the budget on first use. b.mu must be held.
+func (b *retryBudget) fill(p *RetryPolicy) {
+	if !b.init {
+		b.tokens = float64(retryBudgetMax(p))
+		b.init = true
+	}
+}
+
+func retryBudgetMax(p *RetryPolicy) int {
+	if p.Budget <= 0 {
+		return defaultRetryBudget
+	}
+	return p.Budget
+}
+
+// replayable reports whether the request may be sent more than once.
+func replayable(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody && r.GetBody == nil {
+		return false
+	}
+
+	switch r.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.GetBody != nil
+}
+
+// shouldRetry reports whether an attempt failed in a way another
+// endpoint might not.
+func shouldRetry(r *http.Request, response *http.Response, err error) bool {
+	if r.Context().Err() != nil {
+		return false
+	}
+
+	var authErr *authHeaderError
+	if errors.As(err, &authErr) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+
+	switch response.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryPicks is how many times a load balancer is asked for an endpoint
+// not yet tried before one already tried is reused.
+const retryPicks = 3
+
+// nextUntried returns an endpoint for a retry, preferring one not in
+// tried. Retries use Next rather than NextRequest so that requests
+// pinned to a failing endpoint can move to another.
+func (e *balancerEntry) nextUntried(tried map[string]bool) (Endpoint, error) {
+	var endpoint Endpoint
+	for i := 0; i < retryPicks; i++ {
+		if i > 0 {
+			e.release(endpoint)
+		}
+
+		var err error
+		endpoint, err = e.lb.Next()
+		if err != nil {
+			return Endpoint{}, err
+		}
+		if !tried[endpointKey(endpoint)] {
+			break
+		}
+	}
+	return endpoint, nil
+}
+
+// release tells a load balancer that tracks outstanding requests that
+// no request will be sent to endpoint after all.
+func (e *balancerEntry) release(endpoint Endpoint) {
+	if tracker, ok := e.lb.(TrackingLoadBalancer); ok {
+		tracker.Done(endpoint)
+	}
+}
+
+// roundTripRetry sends the request to endpoint, retrying on other
+// endpoints of the service as allowed by the retry policy.
+func (t *Transport) roundTripRetry(r *http.Request, entry *balancerEntry, endpoint Endpoint) (*http.Response, error) {
+	policy := t.Retry
+	tried := make(map[string]bool)
+
+	for attempt := 1; ; attempt++ {
+		tried[endpointKey(endpoint)] = true
+
+		response, err := t.tryEndpoint(r, entry, endpoint, attempt)
+
+		retry := shouldRetry(r, response, err) && attempt < policy.maxAttempts()
+		if !retry {
+			if err != nil {
+				return nil, err
+			}
+			if response.StatusCode < 500 {
+				t.retries.deposit(policy)
+			}
+			response.Header.Set(AttemptsHeader, strconv.Itoa(attempt))
+			return response, nil
+		}
+
+		next, nextErr := entry.nextUntried(tried)
+		if nextErr != nil || !t.retries.withdraw(policy) {
+			if nextErr == nil {
+				entry.release(next)
+			}
+			if err != nil {
+				return nil, err
+			}
+			response.Header.Set(AttemptsHeader, strconv.Itoa(attempt))
+			return response, nil
+		}
+
+		if policy.OnRetry != nil {
+			policy.OnRetry(r, attempt, response, err)
+		}
+
+		if response != nil {
+			io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+			response.Body.Close()
+		}
+
+		endpoint = next
+	}
+}
+
+// tryEndpoint makes a single attempt to send the request to endpoint.
+func (t *Transport) tryEndpoint(r *http.Request, entry *balancerEntry, endpoint Endpoint, attempt int) (*http.Response, error) {
+	ctx, cancel := r.Context(), context.CancelFunc(func() {})
+	if t.Retry.PerTryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.Retry.PerTryTimeout)
+	}
+
+	request := r.Clone(ctx)
+	if attempt > 1 && r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			cancel()
+			entry.release(endpoint)
+			return nil, err
+		}
+		request.Body = body
+	}
+
+	response, err := t.roundTripEndpoint(request, endpoint)
+	response, err = entry.done(r, endpoint, response, err)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	response.Body = &doneBody{ReadCloser: response.Body, done: cancel}
+	return response, nil
+}
@@ -0,0 +1,168 @@
+package run
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+// retryBackends starts a backend that always responds with status and
+// a healthy backend that echoes the request body, and returns a
+// Transport balancing across them in that order.
+func retryBackends(t *testing.T, status int, policy *RetryPolicy) (*Transport, *int32) {
+	t.Helper()
+
+	var failures int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failures, 1)
+		http.Error(w, "failing", status)
+	}))
+	t.Cleanup(failing.Close)
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(healthy.Close)
+
+	tr := &Transport{
+		Environment: balancerEnvironment(t, []gcptest.Endpoint{testEndpoint(t, failing), testEndpoint(t, healthy)}),
+		Retry:       policy,
+	}
+	t.Cleanup(func() { tr.Close() })
+
+	return tr, &failures
+}
+
+func TestTransportRetry(t *testing.T) {
+	var retries int32
+	tr, failures := retryBackends(t, http.StatusServiceUnavailable, &RetryPolicy{
+		OnRetry: func(r *http.Request, attempts int, response *http.Response, err error) {
+			atomic.AddInt32(&retries, 1)
+			if response == nil || response.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("retried response mismatch; want 503, got %v (%v)", response, err)
+			}
+		},
+	})
+
+	response, err := (&http.Client{Transport: tr}).Get("http://test.test.run.local/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != 200 {
+		t.Errorf("status code mismatch; want 200, got %d", response.StatusCode)
+	}
+	if attempts := response.Header.Get(AttemptsHeader); attempts != "2" {
+		t.Errorf("attempts mismatch; want 2, got %q", attempts)
+	}
+	if n := atomic.LoadInt32(failures); n != 1 {
+		t.Errorf("failing backend request count mismatch; want 1, got %d", n)
+	}
+	if n := atomic.LoadInt32(&retries); n != 1 {
+		t.Errorf("retry count mismatch; want 1, got %d", n)
+	}
+}
+
+func TestTransportRetryReplaysBody(t *testing.T) {
+	tr, _ := retryBackends(t, http.StatusBadGateway, &RetryPolicy{})
+
+	response, err := (&http.Client{Transport: tr}).Post("http://test.test.run.local/", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "hello" {
+		t.Errorf("body mismatch; want %q, got %q", "hello", data)
+	}
+}
+
+func TestTransportRetryNotReplayable(t *testing.T) {
+	tr, _ := retryBackends(t, http.StatusServiceUnavailable, &RetryPolicy{})
+
+	// Hide the strings.Reader so that GetBody is not set.
+	body := io.NopCloser(struct{ io.Reader }{strings.NewReader("hello")})
+
+	request, err := http.NewRequest("POST", "http://test.test.run.local/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := (&http.Client{Transport: tr}).Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status code mismatch; want 503, got %d", response.StatusCode)
+	}
+}
+
+func TestTransportRetryBudget(t *testing.T) {
+	tr, failures := retryBackends(t, http.StatusServiceUnavailable, &RetryPolicy{Budget: 1})
+
+	httpClient := &http.Client{Transport: tr}
+
+	// The first request spends the only token retrying on the healthy
+	// backend. The second is sent to the failing backend and, with no
+	// tokens left, is not retried.
+	for _, want := range []int{200, http.StatusServiceUnavailable} {
+		response, err := httpClient.Get("http://test.test.run.local/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != want {
+			t.Errorf("status code mismatch; want %d, got %d", want, response.StatusCode)
+		}
+	}
+
+	if n := atomic.LoadInt32(failures); n != 2 {
+		t.Errorf("failing backend request count mismatch; want 2, got %d", n)
+	}
+}
+
+func TestTransportRetryPerTryTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	tr := &Transport{
+		Environment: balancerEnvironment(t, []gcptest.Endpoint{testEndpoint(t, slow), testEndpoint(t, fast)}),
+		Retry:       &RetryPolicy{PerTryTimeout: 50 * time.Millisecond},
+	}
+	defer tr.Close()
+
+	response, err := (&http.Client{Transport: tr}).Get("http://test.test.run.local/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if attempts := response.Header.Get(AttemptsHeader); attempts != "2" {
+		t.Errorf("attempts mismatch; want 2, got %q", attempts)
+	}
+}
@@ -1,17 +1,13 @@
 package run
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"time"
-)
-
-var (
-	secretmanagerEndpoint = "https://secretmanager.googleapis.com/v1"
 )
 
 // ErrSecretPermissionDenied is returned when access to a secret is denied.
@@ -60,34 +56,61 @@ func formatSecretVersion(project, name, version string) string {
 // AccessSecretVersion returns a Google Cloud Secret for the given
 // secret name and version.
 func AccessSecretVersion(name, version string) ([]byte, error) {
-	return accessSecretVersion(name, version)
+	return DefaultEnvironment.AccessSecretVersion(context.Background(), name, version)
+}
+
+// AccessSecretVersionContext is like AccessSecretVersion but uses the
+// given context.
+func AccessSecretVersionContext(ctx context.Context, name, version string) ([]byte, error) {
+	return DefaultEnvironment.AccessSecretVersion(ctx, name, version)
 }
 
 // AccessSecret returns the latest version of a Google Cloud Secret
 // for the given name.
 func AccessSecret(name string) ([]byte, error) {
-	return accessSecretVersion(name, "latest")
+	return DefaultEnvironment.AccessSecretVersion(context.Background(), name, "latest")
 }
 
-func accessSecretVersion(name, version string) ([]byte, error) {
+// AccessSecretContext is like AccessSecret but uses the given context.
+func AccessSecretContext(ctx context.Context, name string) ([]byte, error) {
+	return DefaultEnvironment.AccessSecretVersion(ctx, name, "latest")
+}
+
+// AccessSecret returns the latest version of a Google Cloud Secret
+// for the given name.
+func (e *Environment) AccessSecret(ctx context.Context, name string) ([]byte, error) {
+	return e.AccessSecretVersion(ctx, name, "latest")
+}
+
+// AccessSecretVersion returns a Google Cloud Secret for the given
+// secret name and version.
+func (e *Environment) AccessSecretVersion(ctx context.Context, name, version string) ([]byte, error) {
 	if version == "" {
 		version = "latest"
 	}
 
-	token, err := Token([]string{"https://www.googleapis.com/auth/cloud-platform"})
+	ctx, cancel := e.withAPITimeout(ctx)
+	defer cancel()
+
+	token, err := e.Token(ctx, []string{"https://www.googleapis.com/auth/cloud-platform"})
 	if err != nil {
 		return nil, err
 	}
 
-	numericProjectID, err := NumericProjectID()
+	// Fallback sources only know the project ID, which Secret Manager
+	// accepts in place of the project number.
+	numericProjectID, err := e.NumericProjectID(ctx)
+	if errors.Is(err, ErrMetadataUnavailable) {
+		numericProjectID, err = e.ProjectID(ctx)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	secretVersion := formatSecretVersion(numericProjectID, name, version)
-	endpoint := fmt.Sprintf("%s/%s:access", secretmanagerEndpoint, secretVersion)
+	endpoint := fmt.Sprintf("%s/%s:access", e.SecretManagerEndpoint, secretVersion)
 
-	request, err := http.NewRequest("GET", endpoint, nil)
+	request, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -95,10 +118,7 @@ func accessSecretVersion(name, version string) ([]byte, error) {
 	request.Header.Set("User-Agent", userAgent)
 	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
 
-	timeout := time.Duration(5) * time.Second
-	httpClient := http.Client{Timeout: timeout}
-
-	response, err := httpClient.Do(request)
+	response, err := e.httpClient().Do(request)
 	if err != nil {
 		return nil, err
 	}
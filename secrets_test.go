@@ -2,6 +2,7 @@ package run
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -26,12 +27,12 @@ func TestAccessSecret(t *testing.T) {
 	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
 	defer ms.Close()
 
-	metadataEndpoint = ms.URL
+	DefaultEnvironment.MetadataEndpoint = ms.URL
 
 	ss := httptest.NewServer(http.HandlerFunc(gcptest.SecretsHandler))
 	defer ss.Close()
 
-	secretmanagerEndpoint = ss.URL
+	DefaultEnvironment.SecretManagerEndpoint = ss.URL
 
 	for _, tt := range accessSecretTests {
 		secret, err := AccessSecret(tt.name)
@@ -49,12 +50,12 @@ func TestAccessSecretVersion(t *testing.T) {
 	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
 	defer ms.Close()
 
-	metadataEndpoint = ms.URL
+	DefaultEnvironment.MetadataEndpoint = ms.URL
 
 	ss := httptest.NewServer(http.HandlerFunc(gcptest.SecretsHandler))
 	defer ss.Close()
 
-	secretmanagerEndpoint = ss.URL
+	DefaultEnvironment.SecretManagerEndpoint = ss.URL
 
 	secret, err := AccessSecretVersion("foo", "1")
 	if err != nil {
@@ -65,3 +66,32 @@ func TestAccessSecretVersion(t *testing.T) {
 		t.Errorf("want %v, got %v", "Test", secret)
 	}
 }
+
+func TestAccessSecretContext(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ms.URL
+
+	ss := httptest.NewServer(http.HandlerFunc(gcptest.SecretsHandler))
+	defer ss.Close()
+
+	DefaultEnvironment.SecretManagerEndpoint = ss.URL
+
+	secret, err := AccessSecretContext(context.Background(), "foo")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(secret, []byte("Test")) {
+		t.Errorf("want %v, got %v", "Test", secret)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = AccessSecretVersionContext(ctx, "foo", "1")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error, want %q, got %q", context.Canceled, err)
+	}
+}
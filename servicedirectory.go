@@ -0,0 +1,409 @@
+package run
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrNamespaceNotFound is returned when a Service Directory namespace
+// is not found.
+var ErrNamespaceNotFound = errors.New("run: service directory namespace not found")
+
+// ErrEndpointNotFound is returned when a Service Directory endpoint is
+// not found.
+var ErrEndpointNotFound = errors.New("run: service directory endpoint not found")
+
+// ErrAlreadyExists is returned when creating a Service Directory
+// namespace, service, or endpoint that already exists.
+var ErrAlreadyExists = errors.New("run: service directory resource already exists")
+
+// ErrServiceDirectoryPermissionDenied is returned when access to the
+// Service Directory API is denied.
+var ErrServiceDirectoryPermissionDenied = errors.New("run: permission denied to service directory resource")
+
+// ErrServiceDirectoryUnauthorized is returned when calls to the Service
+// Directory API are unauthorized.
+var ErrServiceDirectoryUnauthorized = errors.New("run: service directory api unauthorized")
+
+// ErrServiceDirectoryUnknownError is return when calls to the Service
+// Directory API return an unknown error.
+var ErrServiceDirectoryUnknownError = errors.New("run: unexpected error calling service directory")
+
+// ErrServiceDirectoryUnexpectedResponse is returned when calls to the
+// Service Directory API return an unexpected response.
+type ErrServiceDirectoryUnexpectedResponse struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *ErrServiceDirectoryUnexpectedResponse) Error() string {
+	return "run: unexpected error calling service directory"
+}
+
+func (e *ErrServiceDirectoryUnexpectedResponse) Unwrap() error { return e.Err }
+
+// Namespace represents a Service Directory namespace.
+type Namespace struct {
+	// Name is the resource name of the namespace, in the form
+	// projects/*/locations/*/namespaces/*.
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// DirectoryService represents a Service Directory service.
+type DirectoryService struct {
+	// Name is the resource name of the service, in the form
+	// projects/*/locations/*/namespaces/*/services/*.
+	Name        string            `json:"name,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Endpoints is only set by ResolveService.
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+}
+
+type resolveServiceResponse struct {
+	Service DirectoryService `json:"service"`
+}
+
+// CreateNamespace creates a Service Directory namespace in the current
+// project and region.
+func CreateNamespace(namespace string, labels map[string]string) (*Namespace, error) {
+	return DefaultEnvironment.CreateNamespace(context.Background(), namespace, labels)
+}
+
+// CreateNamespaceContext is like CreateNamespace but uses the given
+// context.
+func CreateNamespaceContext(ctx context.Context, namespace string, labels map[string]string) (*Namespace, error) {
+	return DefaultEnvironment.CreateNamespace(ctx, namespace, labels)
+}
+
+// CreateNamespace creates a Service Directory namespace in the current
+// project and region.
+func (e *Environment) CreateNamespace(ctx context.Context, namespace string, labels map[string]string) (*Namespace, error) {
+	query := url.Values{"namespaceId": {namespace}}
+
+	var result Namespace
+	err := e.serviceDirectoryRequest(ctx, http.MethodPost, "namespaces", query, Namespace{Labels: labels}, ErrNamespaceNotFound, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetNamespace returns a Service Directory namespace.
+func GetNamespace(namespace string) (*Namespace, error) {
+	return DefaultEnvironment.GetNamespace(context.Background(), namespace)
+}
+
+// GetNamespaceContext is like GetNamespace but uses the given context.
+func GetNamespaceContext(ctx context.Context, namespace string) (*Namespace, error) {
+	return DefaultEnvironment.GetNamespace(ctx, namespace)
+}
+
+// GetNamespace returns a Service Directory namespace.
+func (e *Environment) GetNamespace(ctx context.Context, namespace string) (*Namespace, error) {
+	var result Namespace
+	err := e.serviceDirectoryRequest(ctx, http.MethodGet, namespacePath(namespace), nil, nil, ErrNamespaceNotFound, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DeleteNamespace deletes a Service Directory namespace along with all
+// of its services and endpoints.
+func DeleteNamespace(namespace string) error {
+	return DefaultEnvironment.DeleteNamespace(context.Background(), namespace)
+}
+
+// DeleteNamespaceContext is like DeleteNamespace but uses the given
+// context.
+func DeleteNamespaceContext(ctx context.Context, namespace string) error {
+	return DefaultEnvironment.DeleteNamespace(ctx, namespace)
+}
+
+// DeleteNamespace deletes a Service Directory namespace along with all
+// of its services and endpoints.
+func (e *Environment) DeleteNamespace(ctx context.Context, namespace string) error {
+	return e.serviceDirectoryRequest(ctx, http.MethodDelete, namespacePath(namespace), nil, nil, ErrNamespaceNotFound, nil)
+}
+
+// CreateDirectoryService creates a service in a Service Directory
+// namespace.
+func CreateDirectoryService(namespace, service string, annotations map[string]string) (*DirectoryService, error) {
+	return DefaultEnvironment.CreateDirectoryService(context.Background(), namespace, service, annotations)
+}
+
+// CreateDirectoryServiceContext is like CreateDirectoryService but uses
+// the given context.
+func CreateDirectoryServiceContext(ctx context.Context, namespace, service string, annotations map[string]string) (*DirectoryService, error) {
+	return DefaultEnvironment.CreateDirectoryService(ctx, namespace, service, annotations)
+}
+
+// CreateDirectoryService creates a service in a Service Directory
+// namespace.
+func (e *Environment) CreateDirectoryService(ctx context.Context, namespace, service string, annotations map[string]string) (*DirectoryService, error) {
+	query := url.Values{"serviceId": {service}}
+
+	var result DirectoryService
+	err := e.serviceDirectoryRequest(ctx, http.MethodPost, namespacePath(namespace)+"/services", query, DirectoryService{Annotations: annotations}, ErrNamespaceNotFound, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetDirectoryService returns a Service Directory service.
+func GetDirectoryService(namespace, service string) (*DirectoryService, error) {
+	return DefaultEnvironment.GetDirectoryService(context.Background(), namespace, service)
+}
+
+// GetDirectoryServiceContext is like GetDirectoryService but uses the
+// given context.
+func GetDirectoryServiceContext(ctx context.Context, namespace, service string) (*DirectoryService, error) {
+	return DefaultEnvironment.GetDirectoryService(ctx, namespace, service)
+}
+
+// GetDirectoryService returns a Service Directory service.
+func (e *Environment) GetDirectoryService(ctx context.Context, namespace, service string) (*DirectoryService, error) {
+	var result DirectoryService
+	err := e.serviceDirectoryRequest(ctx, http.MethodGet, servicePath(namespace, service), nil, nil, ErrServiceNotFound, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DeleteDirectoryService deletes a Service Directory service along with
+// all of its endpoints.
+func DeleteDirectoryService(namespace, service string) error {
+	return DefaultEnvironment.DeleteDirectoryService(context.Background(), namespace, service)
+}
+
+// DeleteDirectoryServiceContext is like DeleteDirectoryService but uses
+// the given context.
+func DeleteDirectoryServiceContext(ctx context.Context, namespace, service string) error {
+	return DefaultEnvironment.DeleteDirectoryService(ctx, namespace, service)
+}
+
+// DeleteDirectoryService deletes a Service Directory service along with
+// all of its endpoints.
+func (e *Environment) DeleteDirectoryService(ctx context.Context, namespace, service string) error {
+	return e.serviceDirectoryRequest(ctx, http.MethodDelete, servicePath(namespace, service), nil, nil, ErrServiceNotFound, nil)
+}
+
+// ResolveService returns a Service Directory service along with its
+// endpoints.
+func ResolveService(namespace, service string) (*DirectoryService, error) {
+	return DefaultEnvironment.ResolveService(context.Background(), namespace, service)
+}
+
+// ResolveServiceContext is like ResolveService but uses the given
+// context.
+func ResolveServiceContext(ctx context.Context, namespace, service string) (*DirectoryService, error) {
+	return DefaultEnvironment.ResolveService(ctx, namespace, service)
+}
+
+// ResolveService returns a Service Directory service along with its
+// endpoints.
+func (e *Environment) ResolveService(ctx context.Context, namespace, service string) (*DirectoryService, error) {
+	var result resolveServiceResponse
+	err := e.serviceDirectoryRequest(ctx, http.MethodPost, servicePath(namespace, service)+":resolve", nil, struct{}{}, ErrServiceNotFound, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result.Service, nil
+}
+
+// CreateEndpoint creates an endpoint with the given ID in a Service
+// Directory service.
+func CreateEndpoint(namespace, service, endpointID string, endpoint Endpoint) (*Endpoint, error) {
+	return DefaultEnvironment.CreateEndpoint(context.Background(), namespace, service, endpointID, endpoint)
+}
+
+// CreateEndpointContext is like CreateEndpoint but uses the given
+// context.
+func CreateEndpointContext(ctx context.Context, namespace, service, endpointID string, endpoint Endpoint) (*Endpoint, error) {
+	return DefaultEnvironment.CreateEndpoint(ctx, namespace, service, endpointID, endpoint)
+}
+
+// CreateEndpoint creates an endpoint with the given ID in a Service
+// Directory service.
+func (e *Environment) CreateEndpoint(ctx context.Context, namespace, service, endpointID string, endpoint Endpoint) (*Endpoint, error) {
+	query := url.Values{"endpointId": {endpointID}}
+	endpoint.Name = ""
+
+	var result Endpoint
+	err := e.serviceDirectoryRequest(ctx, http.MethodPost, servicePath(namespace, service)+"/endpoints", query, endpoint, ErrServiceNotFound, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetEndpoint returns an endpoint of a Service Directory service.
+func GetEndpoint(namespace, service, endpointID string) (*Endpoint, error) {
+	return DefaultEnvironment.GetEndpoint(context.Background(), namespace, service, endpointID)
+}
+
+// GetEndpointContext is like GetEndpoint but uses the given context.
+func GetEndpointContext(ctx context.Context, namespace, service, endpointID string) (*Endpoint, error) {
+	return DefaultEnvironment.GetEndpoint(ctx, namespace, service, endpointID)
+}
+
+// GetEndpoint returns an endpoint of a Service Directory service.
+func (e *Environment) GetEndpoint(ctx context.Context, namespace, service, endpointID string) (*Endpoint, error) {
+	var result Endpoint
+	err := e.serviceDirectoryRequest(ctx, http.MethodGet, endpointPath(namespace, service, endpointID), nil, nil, ErrEndpointNotFound, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// UpdateEndpoint updates the given fields of an endpoint of a Service
+// Directory service. Fields are named as in the API: "address", "port",
+// and "annotations". Annotations are replaced, not merged.
+func UpdateEndpoint(namespace, service, endpointID string, endpoint Endpoint, fields ...string) (*Endpoint, error) {
+	return DefaultEnvironment.UpdateEndpoint(context.Background(), namespace, service, endpointID, endpoint, fields...)
+}
+
+// UpdateEndpointContext is like UpdateEndpoint but uses the given
+// context.
+func UpdateEndpointContext(ctx context.Context, namespace, service, endpointID string, endpoint Endpoint, fields ...string) (*Endpoint, error) {
+	return DefaultEnvironment.UpdateEndpoint(ctx, namespace, service, endpointID, endpoint, fields...)
+}
+
+// UpdateEndpoint updates the given fields of an endpoint of a Service
+// Directory service.
+func (e *Environment) UpdateEndpoint(ctx context.Context, namespace, service, endpointID string, endpoint Endpoint, fields ...string) (*Endpoint, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("run: no endpoint fields to update")
+	}
+
+	query := url.Values{"updateMask": {strings.Join(fields, ",")}}
+	endpoint.Name = ""
+
+	var result Endpoint
+	err := e.serviceDirectoryRequest(ctx, http.MethodPatch, endpointPath(namespace, service, endpointID), query, endpoint, ErrEndpointNotFound, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DeleteEndpoint deletes an endpoint of a Service Directory service.
+func DeleteEndpoint(namespace, service, endpointID string) error {
+	return DefaultEnvironment.DeleteEndpoint(context.Background(), namespace, service, endpointID)
+}
+
+// DeleteEndpointContext is like DeleteEndpoint but uses the given
+// context.
+func DeleteEndpointContext(ctx context.Context, namespace, service, endpointID string) error {
+	return DefaultEnvironment.DeleteEndpoint(ctx, namespace, service, endpointID)
+}
+
+// DeleteEndpoint deletes an endpoint of a Service Directory service.
+func (e *Environment) DeleteEndpoint(ctx context.Context, namespace, service, endpointID string) error {
+	return e.serviceDirectoryRequest(ctx, http.MethodDelete, endpointPath(namespace, service, endpointID), nil, nil, ErrEndpointNotFound, nil)
+}
+
+func namespacePath(namespace string) string {
+	return "namespaces/" + namespace
+}
+
+func servicePath(namespace, service string) string {
+	return fmt.Sprintf("namespaces/%s/services/%s", namespace, service)
+}
+
+func endpointPath(namespace, service, endpointID string) string {
+	return fmt.Sprintf("namespaces/%s/services/%s/endpoints/%s", namespace, service, endpointID)
+}
+
+// serviceDirectoryRequest calls the Service Directory API for the
+// resource at path, relative to the current project and region, and
+// decodes the response into v unless v is nil. A 404 response is
+// reported as notFound.
+func (e *Environment) serviceDirectoryRequest(ctx context.Context, method, path string, query url.Values, body interface{}, notFound error, v interface{}) error {
+	ctx, cancel := e.withAPITimeout(ctx)
+	defer cancel()
+
+	token, err := e.Token(ctx, []string{"https://www.googleapis.com/auth/cloud-platform"})
+	if err != nil {
+		return err
+	}
+
+	region, err := e.Region(ctx)
+	if err != nil {
+		return err
+	}
+
+	projectID, err := e.ProjectID(ctx)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/projects/%s/locations/%s/%s", e.ServiceDirectoryEndpoint, projectID, region, path)
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var requestBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, endpoint, requestBody)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("User-Agent", userAgent)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token.AccessToken))
+
+	response, err := e.httpClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch s := response.StatusCode; s {
+	case 200:
+		break
+	case 401:
+		return ErrServiceDirectoryUnauthorized
+	case 403:
+		return ErrServiceDirectoryPermissionDenied
+	case 404:
+		return notFound
+	case 409:
+		return ErrAlreadyExists
+	default:
+		return &ErrServiceDirectoryUnexpectedResponse{s, ErrServiceDirectoryUnknownError}
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,136 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+// serviceDirectoryEnvironment returns an Environment backed by a test
+// metadata server and a Service Directory API served by handler.
+func serviceDirectoryEnvironment(t *testing.T, handler http.Handler) *Environment {
+	t.Helper()
+
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	t.Cleanup(ms.Close)
+
+	ss := httptest.NewServer(handler)
+	t.Cleanup(ss.Close)
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+	e.ServiceDirectoryEndpoint = ss.URL
+
+	return e
+}
+
+func TestServiceDirectoryLifecycle(t *testing.T) {
+	e := serviceDirectoryEnvironment(t, gcptest.NewServiceDirectory())
+	ctx := context.Background()
+
+	namespace, err := e.CreateNamespace(ctx, "prod", map[string]string{"team": "payments"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "projects/test/locations/test/namespaces/prod"; namespace.Name != want {
+		t.Errorf("namespace name mismatch; want %s, got %s", want, namespace.Name)
+	}
+
+	if _, err := e.CreateNamespace(ctx, "prod", nil); err != ErrAlreadyExists {
+		t.Errorf("error mismatch; want %v, got %v", ErrAlreadyExists, err)
+	}
+
+	if _, err := e.CreateDirectoryService(ctx, "prod", "billing", map[string]string{"owner": "payments"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	service, err := e.GetDirectoryService(ctx, "prod", "billing")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if service.Annotations["owner"] != "payments" {
+		t.Errorf("service annotations mismatch; got %v", service.Annotations)
+	}
+
+	endpoint := Endpoint{Address: "10.0.0.1", Port: 8080, Annotations: map[string]string{"version": "v1"}}
+	if _, err := e.CreateEndpoint(ctx, "prod", "billing", "billing-10-0-0-1", endpoint); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	update := Endpoint{Annotations: map[string]string{"version": "v2"}}
+	updated, err := e.UpdateEndpoint(ctx, "prod", "billing", "billing-10-0-0-1", update, "annotations")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated.Address != "10.0.0.1" || updated.Annotations["version"] != "v2" {
+		t.Errorf("updated endpoint mismatch; got %+v", updated)
+	}
+
+	resolved, err := e.ResolveService(ctx, "prod", "billing")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []Endpoint{{
+		Name:        "projects/test/locations/test/namespaces/prod/services/billing/endpoints/billing-10-0-0-1",
+		Address:     "10.0.0.1",
+		Port:        8080,
+		Annotations: map[string]string{"version": "v2"},
+	}}
+	if !reflect.DeepEqual(resolved.Endpoints, want) {
+		t.Errorf("resolved endpoints mismatch; want %+v, got %+v", want, resolved.Endpoints)
+	}
+
+	if err := e.DeleteEndpoint(ctx, "prod", "billing", "billing-10-0-0-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := e.GetEndpoint(ctx, "prod", "billing", "billing-10-0-0-1"); err != ErrEndpointNotFound {
+		t.Errorf("error mismatch; want %v, got %v", ErrEndpointNotFound, err)
+	}
+
+	if err := e.DeleteDirectoryService(ctx, "prod", "billing"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := e.ResolveService(ctx, "prod", "billing"); err != ErrServiceNotFound {
+		t.Errorf("error mismatch; want %v, got %v", ErrServiceNotFound, err)
+	}
+
+	if err := e.DeleteNamespace(ctx, "prod"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := e.GetNamespace(ctx, "prod"); err != ErrNamespaceNotFound {
+		t.Errorf("error mismatch; want %v, got %v", ErrNamespaceNotFound, err)
+	}
+}
+
+func TestServiceDirectoryErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{401, ErrServiceDirectoryUnauthorized},
+		{403, ErrServiceDirectoryPermissionDenied},
+		{500, ErrServiceDirectoryUnknownError},
+	}
+
+	for _, tt := range tests {
+		e := serviceDirectoryEnvironment(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "", tt.status)
+		}))
+
+		_, err := e.GetNamespace(context.Background(), "prod")
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%d: error mismatch; want %v, got %v", tt.status, tt.want, err)
+		}
+	}
+
+	e := serviceDirectoryEnvironment(t, gcptest.NewServiceDirectory())
+	if _, err := e.UpdateEndpoint(context.Background(), "prod", "billing", "id", Endpoint{}); err == nil {
+		t.Error("expected error for empty update mask")
+	}
+}
@@ -0,0 +1,362 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetadataServerSource is the name reported for values supplied by
+// the metadata server.
+const MetadataServerSource = "metadata-server"
+
+// ErrMetadataUnavailable is returned when the metadata server is
+// unreachable and no fallback source supplies the requested value.
+var ErrMetadataUnavailable = errors.New("run: metadata server unavailable and no fallback source found")
+
+// A MetadataSource supplies the project ID, region, and access tokens
+// when the metadata server is unreachable, such as when running on a
+// developer workstation.
+//
+// Methods return ErrMetadataNotFound when the source does not hold the
+// requested value, in which case the next source is consulted.
+type MetadataSource interface {
+	// Name identifies the source in a SourceReport.
+	Name() string
+
+	ProjectID(ctx context.Context) (string, error)
+	Region(ctx context.Context) (string, error)
+	Token(ctx context.Context, scopes []string) (*AccessToken, error)
+}
+
+// A SourceReport names the source supplying each runtime value. A
+// name is empty if no source supplied the value.
+type SourceReport struct {
+	ProjectID string
+	Region    string
+	Token     string
+}
+
+// ActiveSources resolves the project ID, region, and default access
+// token and reports which source supplied each.
+func ActiveSources(ctx context.Context) SourceReport {
+	return DefaultEnvironment.ActiveSources(ctx)
+}
+
+// ActiveSources resolves the project ID, region, and default access
+// token and reports which source supplied each.
+func (e *Environment) ActiveSources(ctx context.Context) SourceReport {
+	e.ProjectID(ctx)
+	e.Region(ctx)
+	e.Token(ctx, []string{"https://www.googleapis.com/auth/cloud-platform"})
+
+	e.sourcesMu.Lock()
+	defer e.sourcesMu.Unlock()
+
+	return SourceReport{
+		ProjectID: e.sources["project"],
+		Region:    e.sources["region"],
+		Token:     e.sources["token"],
+	}
+}
+
+// metadataRecheckInterval is how long the metadata server is skipped
+// after it is found to be unreachable before it is tried again.
+const metadataRecheckInterval = time.Minute
+
+// metadataUnreachable reports whether the metadata server was recently
+// found to be unreachable.
+func (e *Environment) metadataUnreachable() bool {
+	e.sourcesMu.Lock()
+	defer e.sourcesMu.Unlock()
+	return time.Now().Before(e.unreachableUntil)
+}
+
+// checkUnreachable reports whether err shows the metadata server could
+// not be reached at all, such as a failed DNS lookup or a refused
+// connection, and if so remembers it so calls within the next
+// metadataRecheckInterval go straight to the fallback sources. A brief
+// outage therefore does not switch sources for the life of the process.
+// Inside Cloud Run the metadata server is always assumed to be
+// reachable.
+func (e *Environment) checkUnreachable(err error) bool {
+	if err == nil || ServiceName() != "" || len(e.FallbackSources) == 0 {
+		return false
+	}
+
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	if !errors.As(err, &opErr) && !errors.As(err, &dnsErr) {
+		return false
+	}
+
+	e.sourcesMu.Lock()
+	defer e.sourcesMu.Unlock()
+
+	if e.unreachableUntil.IsZero() {
+		e.log("NOTICE", fmt.Sprintf("Metadata server unreachable, using fallback sources: %v", err))
+	}
+	e.unreachableUntil = time.Now().Add(metadataRecheckInterval)
+	return true
+}
+
+// fromSource calls metadata unless the metadata server is unreachable,
+// in which case fallback is called on each fallback source in turn and
+// the first value found is returned. The name of the supplying source
+// is recorded under the given kind.
+func (e *Environment) fromSource(ctx context.Context, kind string, metadata func() (string, error), fallback func(MetadataSource) (string, error)) (string, error) {
+	if !e.metadataUnreachable() {
+		v, err := metadata()
+		if err == nil {
+			e.recordSource(kind, MetadataServerSource)
+			return v, nil
+		}
+		if !e.checkUnreachable(err) {
+			return "", err
+		}
+	}
+
+	for _, source := range e.FallbackSources {
+		v, err := fallback(source)
+		if errors.Is(err, ErrMetadataNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		e.recordSource(kind, source.Name())
+		return v, nil
+	}
+
+	return "", ErrMetadataUnavailable
+}
+
+func (e *Environment) recordSource(kind, name string) {
+	e.sourcesMu.Lock()
+	defer e.sourcesMu.Unlock()
+
+	if e.sources == nil {
+		e.sources = make(map[string]string)
+	}
+	e.sources[kind] = name
+}
+
+// EnvSource supplies the project ID and region from environment
+// variables. The project ID is read from GOOGLE_CLOUD_PROJECT,
+// GCLOUD_PROJECT, or CLOUDSDK_CORE_PROJECT, and the region from
+// GOOGLE_CLOUD_REGION, CLOUDSDK_RUN_REGION, or CLOUDSDK_COMPUTE_REGION.
+type EnvSource struct{}
+
+// Name returns "env".
+func (EnvSource) Name() string { return "env" }
+
+// ProjectID returns the project ID set in the environment.
+func (EnvSource) ProjectID(ctx context.Context) (string, error) {
+	return firstEnv("GOOGLE_CLOUD_PROJECT", "GCLOUD_PROJECT", "CLOUDSDK_CORE_PROJECT")
+}
+
+// Region returns the region set in the environment.
+func (EnvSource) Region(ctx context.Context) (string, error) {
+	return firstEnv("GOOGLE_CLOUD_REGION", "CLOUDSDK_RUN_REGION", "CLOUDSDK_COMPUTE_REGION")
+}
+
+// Token always returns ErrMetadataNotFound.
+func (EnvSource) Token(ctx context.Context, scopes []string) (*AccessToken, error) {
+	return nil, ErrMetadataNotFound
+}
+
+func firstEnv(keys ...string) (string, error) {
+	for _, key := range keys {
+		if v := os.Getenv(key); v != "" {
+			return v, nil
+		}
+	}
+	return "", ErrMetadataNotFound
+}
+
+// ErrUnsupportedCredentials is returned when an application default
+// credentials file holds credentials other than a user refresh token.
+var ErrUnsupportedCredentials = errors.New("run: unsupported application default credentials type")
+
+// An ADCSource supplies access tokens from an application default
+// credentials file of type authorized_user, as written by
+// "gcloud auth application-default login", by exchanging its refresh
+// token with the Google OAuth 2.0 token endpoint. The quota project in
+// the file, if any, is supplied as the project ID.
+//
+// Tokens carry the scopes granted when the file was created, so the
+// requested scopes are ignored.
+type ADCSource struct {
+	// Path is the credentials file. If empty, the file named by
+	// GOOGLE_APPLICATION_CREDENTIALS is used, followed by the gcloud
+	// well-known location.
+	Path string
+
+	// TokenEndpoint is the OAuth 2.0 token endpoint. If empty,
+	// https://oauth2.googleapis.com/token is used.
+	TokenEndpoint string
+
+	// HTTPClient is used to exchange the refresh token. If nil, the
+	// HTTPClient of the Environment that installed the source is used,
+	// falling back to http.DefaultClient.
+	HTTPClient *http.Client
+
+	// defaultClient returns the client of the Environment that
+	// installed the source, if any.
+	defaultClient func() *http.Client
+
+	once        sync.Once
+	credentials *adcCredentials
+	err         error
+}
+
+type adcCredentials struct {
+	Type           string `json:"type"`
+	ClientID       string `json:"client_id"`
+	ClientSecret   string `json:"client_secret"`
+	RefreshToken   string `json:"refresh_token"`
+	QuotaProjectID string `json:"quota_project_id"`
+}
+
+// Name returns "adc".
+func (s *ADCSource) Name() string { return "adc" }
+
+// ProjectID returns the quota project from the credentials file.
+func (s *ADCSource) ProjectID(ctx context.Context) (string, error) {
+	credentials, err := s.load()
+	if err != nil {
+		return "", err
+	}
+
+	if credentials.QuotaProjectID == "" {
+		return "", ErrMetadataNotFound
+	}
+	return credentials.QuotaProjectID, nil
+}
+
+// Region always returns ErrMetadataNotFound.
+func (s *ADCSource) Region(ctx context.Context) (string, error) {
+	return "", ErrMetadataNotFound
+}
+
+// Token exchanges the refresh token in the credentials file for an
+// access token.
+func (s *ADCSource) Token(ctx context.Context, scopes []string) (*AccessToken, error) {
+	credentials, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := s.TokenEndpoint
+	if endpoint == "" {
+		endpoint = "https://oauth2.googleapis.com/token"
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {credentials.ClientID},
+		"client_secret": {credentials.ClientSecret},
+		"refresh_token": {credentials.RefreshToken},
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("User-Agent", userAgent)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpClient := s.HTTPClient
+	if httpClient == nil && s.defaultClient != nil {
+		httpClient = s.defaultClient()
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("run: non 200 response when exchanging refresh token: %s", response.Status)
+	}
+
+	var accessToken AccessToken
+	if err := json.Unmarshal(data, &accessToken); err != nil {
+		return nil, fmt.Errorf("run: error decoding token response: %w", err)
+	}
+
+	return &accessToken, nil
+}
+
+// load reads the credentials file once. A missing file is reported as
+// ErrMetadataNotFound.
+func (s *ADCSource) load() (*adcCredentials, error) {
+	s.once.Do(func() {
+		path := s.Path
+		if path == "" {
+			path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		if path == "" {
+			path = wellKnownADCPath()
+		}
+
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			s.err = ErrMetadataNotFound
+			return
+		}
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		var credentials adcCredentials
+		if err := json.Unmarshal(data, &credentials); err != nil {
+			s.err = fmt.Errorf("run: error decoding %s: %w", path, err)
+			return
+		}
+
+		if credentials.Type != "authorized_user" {
+			s.err = fmt.Errorf("%w: %q", ErrUnsupportedCredentials, credentials.Type)
+			return
+		}
+
+		s.credentials = &credentials
+	})
+	return s.credentials, s.err
+}
+
+// wellKnownADCPath returns the location gcloud writes application
+// default credentials to.
+func wellKnownADCPath() string {
+	const name = "application_default_credentials.json"
+
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", name)
+	}
+
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "gcloud", name)
+}
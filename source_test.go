@@ -0,0 +1,222 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+// unreachableEnvironment returns an Environment whose metadata server
+// refuses connections.
+func unreachableEnvironment(t *testing.T, sources ...MetadataSource) *Environment {
+	t.Helper()
+	t.Setenv("K_SERVICE", "")
+
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	ms.Close()
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+	e.MetadataRetries = 0
+	e.FallbackSources = sources
+	e.Logger = NewLogger()
+	e.Logger.SetOutput(io.Discard)
+
+	return e
+}
+
+func writeADCFile(t *testing.T, data string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "application_default_credentials.json")
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFallbackSources(t *testing.T) {
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "env-test")
+	t.Setenv("GOOGLE_CLOUD_REGION", "us-test1")
+
+	ts := httptest.NewServer(http.HandlerFunc(gcptest.OAuthTokenHandler))
+	defer ts.Close()
+
+	adc := &ADCSource{
+		Path:          writeADCFile(t, gcptest.ADCCredentials),
+		TokenEndpoint: ts.URL,
+	}
+
+	e := unreachableEnvironment(t, EnvSource{}, adc)
+	ctx := context.Background()
+
+	projectID, err := e.ProjectID(ctx)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if projectID != "env-test" {
+		t.Errorf("want %v, got %v", "env-test", projectID)
+	}
+
+	region, err := e.Region(ctx)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if region != "us-test1" {
+		t.Errorf("want %v, got %v", "us-test1", region)
+	}
+
+	token, err := e.Token(ctx, []string{"https://www.googleapis.com/auth/cloud-platform"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token.AccessToken != gcptest.UserAccessToken {
+		t.Errorf("want %v, got %v", gcptest.UserAccessToken, token.AccessToken)
+	}
+
+	want := SourceReport{ProjectID: "env", Region: "env", Token: "adc"}
+	if report := e.ActiveSources(ctx); report != want {
+		t.Errorf("want %+v, got %+v", want, report)
+	}
+}
+
+func TestFallbackSourcesQuotaProject(t *testing.T) {
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "")
+	t.Setenv("GCLOUD_PROJECT", "")
+	t.Setenv("CLOUDSDK_CORE_PROJECT", "")
+
+	adc := &ADCSource{Path: writeADCFile(t, gcptest.ADCCredentials)}
+	e := unreachableEnvironment(t, EnvSource{}, adc)
+
+	projectID, err := e.ProjectID(context.Background())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if projectID != gcptest.QuotaProjectID {
+		t.Errorf("want %v, got %v", gcptest.QuotaProjectID, projectID)
+	}
+}
+
+func TestFallbackSourcesUnavailable(t *testing.T) {
+	t.Setenv("GOOGLE_CLOUD_REGION", "")
+	t.Setenv("CLOUDSDK_RUN_REGION", "")
+	t.Setenv("CLOUDSDK_COMPUTE_REGION", "")
+
+	adc := &ADCSource{Path: filepath.Join(t.TempDir(), "missing.json")}
+	e := unreachableEnvironment(t, EnvSource{}, adc)
+
+	if _, err := e.Region(context.Background()); !errors.Is(err, ErrMetadataUnavailable) {
+		t.Errorf("unexpected error, want %q, got %q", ErrMetadataUnavailable, err)
+	}
+
+	_, err := e.Token(context.Background(), []string{"https://www.googleapis.com/auth/cloud-platform"})
+	if !errors.Is(err, ErrMetadataUnavailable) {
+		t.Errorf("unexpected error, want %q, got %q", ErrMetadataUnavailable, err)
+	}
+}
+
+func TestFallbackSourcesNumericProjectID(t *testing.T) {
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "env-test")
+
+	e := unreachableEnvironment(t, EnvSource{})
+
+	if _, err := e.NumericProjectID(context.Background()); !errors.Is(err, ErrMetadataUnavailable) {
+		t.Errorf("unexpected error, want %q, got %q", ErrMetadataUnavailable, err)
+	}
+}
+
+func TestFallbackSourcesRecheckMetadataServer(t *testing.T) {
+	t.Setenv("GOOGLE_CLOUD_PROJECT", "env-test")
+	t.Setenv("GOOGLE_CLOUD_REGION", "")
+	t.Setenv("CLOUDSDK_RUN_REGION", "")
+	t.Setenv("CLOUDSDK_COMPUTE_REGION", "")
+
+	e := unreachableEnvironment(t, EnvSource{})
+	ctx := context.Background()
+
+	if projectID, err := e.ProjectID(ctx); err != nil || projectID != "env-test" {
+		t.Fatalf("want %v, got %v (%v)", "env-test", projectID, err)
+	}
+
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	e.MetadataEndpoint = ms.URL
+
+	if _, err := e.Region(ctx); !errors.Is(err, ErrMetadataUnavailable) {
+		t.Errorf("unexpected error before recheck, want %q, got %q", ErrMetadataUnavailable, err)
+	}
+
+	e.sourcesMu.Lock()
+	e.unreachableUntil = time.Now().Add(-time.Second)
+	e.sourcesMu.Unlock()
+
+	region, err := e.Region(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error after recheck: %v", err)
+	}
+	if region != gcptest.Region {
+		t.Errorf("want %v, got %v", gcptest.Region, region)
+	}
+}
+
+func TestADCSourceUnsupportedCredentials(t *testing.T) {
+	adc := &ADCSource{Path: writeADCFile(t, `{"type": "service_account"}`)}
+
+	_, err := adc.Token(context.Background(), nil)
+	if !errors.Is(err, ErrUnsupportedCredentials) {
+		t.Errorf("unexpected error, want %q, got %q", ErrUnsupportedCredentials, err)
+	}
+}
+
+func TestADCSourceEnvironmentHTTPClient(t *testing.T) {
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", writeADCFile(t, gcptest.ADCCredentials))
+
+	var host string
+	e := NewEnvironment()
+	e.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			host = r.URL.Host
+			w := httptest.NewRecorder()
+			gcptest.OAuthTokenHandler(w, r)
+			return w.Result(), nil
+		}),
+	}
+
+	token, err := e.FallbackSources[1].Token(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token.AccessToken != gcptest.UserAccessToken {
+		t.Errorf("want %v, got %v", gcptest.UserAccessToken, token.AccessToken)
+	}
+	if host != "oauth2.googleapis.com" {
+		t.Errorf("expected token exchange through the environment's HTTP client, got host %q", host)
+	}
+}
+
+func TestActiveSourcesMetadataServer(t *testing.T) {
+	ms := httptest.NewServer(http.HandlerFunc(gcptest.MetadataHandler))
+	defer ms.Close()
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+
+	want := SourceReport{
+		ProjectID: MetadataServerSource,
+		Region:    MetadataServerSource,
+		Token:     MetadataServerSource,
+	}
+
+	if report := e.ActiveSources(context.Background()); report != want {
+		t.Errorf("want %+v, got %+v", want, report)
+	}
+}
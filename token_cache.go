@@ -0,0 +1,233 @@
+package run
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// expiryDelta is subtracted from a token's expiry time so that a token
+// is never handed out moments before it expires.
+const expiryDelta = 10 * time.Second
+
+// maxCachedTokens bounds the number of tokens a tokenCache holds, as
+// keys such as ID token audiences may be chosen per request.
+const maxCachedTokens = 1000
+
+// A token holds a cached OAuth 2.0 access token or OpenID Connect
+// ID token.
+type token struct {
+	value     string
+	tokenType string
+	expiry    time.Time
+}
+
+// valid reports whether the token can be handed out at the given time.
+func (t *token) valid(now time.Time) bool {
+	return !t.expiry.IsZero() && now.Before(t.expiry.Add(-expiryDelta))
+}
+
+// accessToken returns t as an AccessToken.
+func (t *token) accessToken() *AccessToken {
+	return &AccessToken{
+		AccessToken: t.value,
+		ExpiresIn:   int64(time.Until(t.expiry).Seconds()),
+		TokenType:   t.tokenType,
+	}
+}
+
+// idTokenFromJWT returns a token for the given ID token, expiring at
+// its exp claim.
+func idTokenFromJWT(idToken string) (*token, error) {
+	expiry, err := jwtExpiry(idToken)
+	if err != nil {
+		return nil, fmt.Errorf("run: error parsing id token: %w", err)
+	}
+
+	return &token{value: idToken, expiry: expiry}, nil
+}
+
+// A tokenCall represents an in-flight token fetch.
+type tokenCall struct {
+	done  chan struct{}
+	token *token
+	err   error
+}
+
+// A tokenCache caches tokens by key until they expire.
+//
+// Expired tokens are dropped when new tokens are stored, and the
+// soonest-expiring token is evicted if the cache is full.
+//
+// Tokens are refreshed in the background once they are within
+// refreshAhead of their expiry, and concurrent fetches for the same
+// key are deduplicated so a burst of callers results in a single
+// call to fetch. Fetches are not bound to any one caller's context so
+// that a cancelled caller does not fail the others waiting on it.
+type tokenCache struct {
+	fetch        func(ctx context.Context, key string) (*token, error)
+	refreshAhead time.Duration
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+
+	mu       sync.Mutex
+	tokens   map[string]*token
+	inflight map[string]*tokenCall
+}
+
+// CacheStats holds token cache hit and miss counters.
+type CacheStats struct {
+	// Hits is the number of lookups served from the cache.
+	Hits uint64
+
+	// Misses is the number of lookups that waited on a token fetch.
+	Misses uint64
+}
+
+func newTokenCache(refreshAhead time.Duration, fetch func(ctx context.Context, key string) (*token, error)) *tokenCache {
+	return &tokenCache{
+		fetch:        fetch,
+		refreshAhead: refreshAhead,
+		tokens:       make(map[string]*token),
+		inflight:     make(map[string]*tokenCall),
+	}
+}
+
+// Get returns the cached token for key, fetching a new one if the
+// cached token is missing or expired. If ctx is done before the fetch
+// completes Get returns ctx.Err().
+func (c *tokenCache) Get(ctx context.Context, key string) (*token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	if t, ok := c.tokens[key]; ok && t.valid(now) {
+		if t.expiry.Sub(now) < c.refreshAhead {
+			c.start(key)
+		}
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return t, nil
+	}
+
+	call := c.start(key)
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Stats returns the cache hit and miss counters.
+func (c *tokenCache) Stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+// start begins fetching a token for key unless a fetch is already in
+// flight. The caller must hold c.mu.
+func (c *tokenCache) start(key string) *tokenCall {
+	if call, ok := c.inflight[key]; ok {
+		return call
+	}
+
+	call := &tokenCall{done: make(chan struct{})}
+	c.inflight[key] = call
+
+	go func() {
+		call.token, call.err = c.fetch(context.Background(), key)
+
+		c.mu.Lock()
+		if now := time.Now(); call.err == nil && call.token.valid(now) {
+			c.store(key, call.token, now)
+		}
+		delete(c.inflight, key)
+		c.mu.Unlock()
+
+		close(call.done)
+	}()
+
+	return call
+}
+
+// store caches t for key, first dropping expired tokens and, if the
+// cache is full, the token closest to expiry. The caller must hold c.mu.
+func (c *tokenCache) store(key string, t *token, now time.Time) {
+	if _, ok := c.tokens[key]; !ok {
+		for k, cached := range c.tokens {
+			if !cached.valid(now) {
+				delete(c.tokens, k)
+			}
+		}
+
+		for len(c.tokens) >= maxCachedTokens {
+			var oldest string
+			for k, cached := range c.tokens {
+				if oldest == "" || cached.expiry.Before(c.tokens[oldest].expiry) {
+					oldest = k
+				}
+			}
+			delete(c.tokens, oldest)
+		}
+	}
+
+	c.tokens[key] = t
+}
+
+// scopesKey returns a cache key that is the same for any ordering of
+// the given scopes.
+func scopesKey(scopes []string) string {
+	s := make([]string, 0, len(scopes))
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		if seen[scope] {
+			continue
+		}
+		seen[scope] = true
+		s = append(s, scope)
+	}
+	sort.Strings(s)
+
+	return strings.Join(s, ",")
+}
+
+// jwtExpiry returns the expiry time from the exp claim of a JWT. The
+// token signature is not verified.
+func jwtExpiry(jwt string) (time.Time, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("run: malformed jwt")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return time.Time{}, err
+	}
+
+	if claims.Exp == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(claims.Exp, 0), nil
+}
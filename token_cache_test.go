@@ -0,0 +1,248 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+var scopesKeyTests = []struct {
+	scopes []string
+	want   string
+}{
+	{nil, ""},
+	{[]string{"b", "a"}, "a,b"},
+	{[]string{"a", "b", "a"}, "a,b"},
+}
+
+func TestScopesKey(t *testing.T) {
+	for _, tt := range scopesKeyTests {
+		if got := scopesKey(tt.scopes); got != tt.want {
+			t.Errorf("want %q, got %q", tt.want, got)
+		}
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	var fetches int32
+	c := newTokenCache(time.Minute, func(ctx context.Context, key string) (*token, error) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(10 * time.Millisecond)
+		return &token{value: key, expiry: time.Now().Add(time.Hour)}, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tok, err := c.Get(context.Background(), "test")
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if tok.value != "test" {
+				t.Errorf("want %v, got %v", "test", tok.value)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := c.Get(context.Background(), "test"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("fetch count mismatch; want 1, got %d", n)
+	}
+}
+
+func TestTokenCacheRefreshAhead(t *testing.T) {
+	fetched := make(chan struct{}, 2)
+	var fetches int32
+	c := newTokenCache(time.Hour, func(ctx context.Context, key string) (*token, error) {
+		n := atomic.AddInt32(&fetches, 1)
+		defer func() { fetched <- struct{}{} }()
+		if n > 1 {
+			return &token{value: "refreshed", expiry: time.Now().Add(2 * time.Hour)}, nil
+		}
+		return &token{value: "initial", expiry: time.Now().Add(time.Minute)}, nil
+	})
+
+	tok, err := c.Get(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-fetched
+
+	// The cached token is inside the refresh window, so it is returned
+	// while a refresh happens in the background.
+	tok, err = c.Get(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tok.value != "initial" {
+		t.Errorf("want %v, got %v", "initial", tok.value)
+	}
+
+	select {
+	case <-fetched:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for background refresh")
+	}
+
+	// Wait for the refreshed token to be stored.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		tok, _ = c.Get(context.Background(), "test")
+		if tok.value == "refreshed" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if tok.value != "refreshed" {
+		t.Errorf("want %v, got %v", "refreshed", tok.value)
+	}
+}
+
+func TestTokenCacheExpired(t *testing.T) {
+	var fetches int32
+	c := newTokenCache(time.Minute, func(ctx context.Context, key string) (*token, error) {
+		atomic.AddInt32(&fetches, 1)
+		return &token{value: key, expiry: time.Now().Add(expiryDelta)}, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.Get(context.Background(), "test"); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetches); n != 3 {
+		t.Errorf("fetch count mismatch; want 3, got %d", n)
+	}
+}
+
+func TestTokenCacheEviction(t *testing.T) {
+	c := newTokenCache(0, func(ctx context.Context, key string) (*token, error) {
+		if key == "short" {
+			return &token{value: key, expiry: time.Now().Add(expiryDelta + 50*time.Millisecond)}, nil
+		}
+		return &token{value: key, expiry: time.Now().Add(time.Hour)}, nil
+	})
+
+	if _, err := c.Get(context.Background(), "short"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < maxCachedTokens+10; i++ {
+		if _, err := c.Get(context.Background(), fmt.Sprintf("audience-%d", i)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.tokens["short"]; ok {
+		t.Error("expected expired token to be dropped")
+	}
+	if n := len(c.tokens); n != maxCachedTokens {
+		t.Errorf("cached token count mismatch; want %d, got %d", maxCachedTokens, n)
+	}
+}
+
+func TestTokenCacheError(t *testing.T) {
+	errFetch := errors.New("fetch failed")
+	c := newTokenCache(time.Minute, func(ctx context.Context, key string) (*token, error) {
+		return nil, errFetch
+	})
+
+	if _, err := c.Get(context.Background(), "test"); !errors.Is(err, errFetch) {
+		t.Errorf("unexpected error, want %q, got %q", errFetch, err)
+	}
+}
+
+func TestTokenCached(t *testing.T) {
+	resetRuntimeMetadata()
+
+	var requests int32
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		gcptest.MetadataHandler(w, r)
+	}))
+	defer ms.Close()
+
+	DefaultEnvironment.MetadataEndpoint = ms.URL
+
+	scopes := []string{"https://www.googleapis.com/auth/cloud-platform"}
+	for i := 0; i < 3; i++ {
+		v, err := Token(scopes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if v.AccessToken != gcptest.AccessToken.AccessToken {
+			t.Errorf("want %v, got %v", gcptest.AccessToken.AccessToken, v.AccessToken)
+		}
+
+		if v.ExpiresIn <= 0 || v.ExpiresIn > gcptest.AccessToken.ExpiresIn {
+			t.Errorf("unexpected expires_in: %d", v.ExpiresIn)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("metadata request count mismatch; want 1, got %d", n)
+	}
+}
+
+var jwtExpiryTests = []struct {
+	jwt  string
+	want time.Time
+	ok   bool
+}{
+	{gcptest.IDToken, time.Unix(4102444800, 0), true},
+	{"eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.e30.sig", time.Time{}, true},
+	{"not-a-jwt", time.Time{}, false},
+	{"a.!!!.c", time.Time{}, false},
+}
+
+func TestJWTExpiry(t *testing.T) {
+	for _, tt := range jwtExpiryTests {
+		got, err := jwtExpiry(tt.jwt)
+		if (err == nil) != tt.ok {
+			t.Errorf("unexpected error for %q: %v", tt.jwt, err)
+		}
+
+		if !got.Equal(tt.want) {
+			t.Errorf("want %v, got %v", tt.want, got)
+		}
+	}
+}
+
+func TestTokenCacheContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	c := newTokenCache(time.Minute, func(ctx context.Context, key string) (*token, error) {
+		<-release
+		return &token{value: key, expiry: time.Now().Add(time.Hour)}, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.Get(ctx, "test"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error, want %q, got %q", context.DeadlineExceeded, err)
+	}
+}
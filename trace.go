@@ -0,0 +1,187 @@
+package run
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	cloudTraceContextHeader = "X-Cloud-Trace-Context"
+	traceparentHeader       = "traceparent"
+)
+
+// A TraceContext identifies a span within a distributed trace.
+type TraceContext struct {
+	// TraceID is the 32 character hex encoded trace ID.
+	TraceID string
+
+	// SpanID is the ID of the span.
+	SpanID uint64
+
+	// Sampled reports whether the trace is being recorded.
+	Sampled bool
+}
+
+type traceContextKey struct{}
+
+// WithTraceContext returns a copy of ctx carrying the given trace
+// context. Transport propagates it to downstream services on requests
+// made with the returned context.
+func WithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContextFromContext returns the trace context carried by ctx.
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
+
+// TraceHandler returns a request handler that extracts the trace
+// context from the X-Cloud-Trace-Context or W3C traceparent header of
+// incoming requests and adds it to the request context before calling
+// h. Pass the request context to outbound requests made with Client to
+// continue the trace in downstream services.
+func TraceHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tc, ok := parseTraceHeaders(r.Header); ok {
+			r = r.WithContext(WithTraceContext(r.Context(), tc))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// parseTraceHeaders returns the trace context from the given headers.
+// The X-Cloud-Trace-Context header, which Logger uses to correlate log
+// entries, takes precedence over the traceparent header.
+func parseTraceHeaders(h http.Header) (TraceContext, bool) {
+	if tc, ok := parseCloudTraceContext(h.Get(cloudTraceContextHeader)); ok {
+		return tc, true
+	}
+	return parseTraceparent(h.Get(traceparentHeader))
+}
+
+// parseCloudTraceContext parses a header value of the form
+// TRACE_ID/SPAN_ID;o=OPTIONS, where the span ID and options are
+// optional.
+func parseCloudTraceContext(s string) (TraceContext, bool) {
+	var tc TraceContext
+
+	s, options, _ := strings.Cut(s, ";")
+	traceID, spanID, hasSpanID := strings.Cut(s, "/")
+
+	if !validTraceID(traceID) {
+		return tc, false
+	}
+	tc.TraceID = strings.ToLower(traceID)
+
+	if hasSpanID {
+		id, err := strconv.ParseUint(spanID, 10, 64)
+		if err != nil {
+			return tc, false
+		}
+		tc.SpanID = id
+	}
+
+	tc.Sampled = options == "o=1"
+	return tc, true
+}
+
+// parseTraceparent parses a W3C traceparent header value of the form
+// VERSION-TRACE_ID-PARENT_ID-FLAGS.
+func parseTraceparent(s string) (TraceContext, bool) {
+	var tc TraceContext
+
+	ss := strings.Split(s, "-")
+	if len(ss) < 4 || len(ss[0]) != 2 || ss[0] == "ff" {
+		return tc, false
+	}
+	if ss[0] == "00" && len(ss) != 4 {
+		return tc, false
+	}
+
+	if !validTraceID(ss[1]) {
+		return tc, false
+	}
+	tc.TraceID = strings.ToLower(ss[1])
+
+	spanID, err := hex.DecodeString(ss[2])
+	if err != nil || len(spanID) != 8 {
+		return tc, false
+	}
+	tc.SpanID = binary.BigEndian.Uint64(spanID)
+	if tc.SpanID == 0 {
+		return tc, false
+	}
+
+	flags, err := hex.DecodeString(ss[3])
+	if err != nil || len(flags) != 1 {
+		return tc, false
+	}
+	tc.Sampled = flags[0]&1 == 1
+
+	return tc, true
+}
+
+// validTraceID reports whether s is a 32 character hex encoded,
+// non-zero trace ID.
+func validTraceID(s string) bool {
+	id, err := hex.DecodeString(s)
+	if err != nil || len(id) != 16 {
+		return false
+	}
+	for _, b := range id {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// child returns a trace context for a new span in the same trace.
+func (tc TraceContext) child() (TraceContext, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return TraceContext{}, err
+		}
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 {
+			tc.SpanID = id
+			return tc, nil
+		}
+	}
+}
+
+// inject sets the X-Cloud-Trace-Context and traceparent headers.
+func (tc TraceContext) inject(h http.Header) {
+	options, flags := "0", "00"
+	if tc.Sampled {
+		options, flags = "1", "01"
+	}
+
+	h.Set(cloudTraceContextHeader, fmt.Sprintf("%s/%d;o=%s", tc.TraceID, tc.SpanID, options))
+	h.Set(traceparentHeader, fmt.Sprintf("00-%s-%016x-%s", tc.TraceID, tc.SpanID, flags))
+}
+
+// injectTraceContext propagates the trace context of the request
+// context, if any, to the request headers as a new child span.
+func injectTraceContext(r *http.Request) error {
+	tc, ok := TraceContextFromContext(r.Context())
+	if !ok {
+		return nil
+	}
+
+	child, err := tc.child()
+	if err != nil {
+		return err
+	}
+
+	child.inject(r.Header)
+	return nil
+}
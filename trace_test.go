@@ -0,0 +1,132 @@
+package run
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testTraceID = "27abb75176a19ccf353146b192ef419f"
+
+func TestParseTraceHeaders(t *testing.T) {
+	tests := []struct {
+		cloudTrace  string
+		traceparent string
+		want        TraceContext
+		ok          bool
+	}{
+		{testTraceID + "/123;o=1", "", TraceContext{testTraceID, 123, true}, true},
+		{testTraceID, "", TraceContext{TraceID: testTraceID}, true},
+		{"", "00-" + testTraceID + "-00000000000000ff-01", TraceContext{testTraceID, 255, true}, true},
+		{"", "00-" + testTraceID + "-00000000000000ff-00", TraceContext{testTraceID, 255, false}, true},
+		{testTraceID + "/1;o=0", "00-0af7651916cd43dd8448eb211c80319c-00000000000000ff-01", TraceContext{testTraceID, 1, false}, true},
+		{"invalid/1", "00-" + testTraceID + "-00000000000000ff-01", TraceContext{testTraceID, 255, true}, true},
+		{"", "00-" + testTraceID + "-0000000000000000-01", TraceContext{}, false},
+		{"", "ff-" + testTraceID + "-00000000000000ff-01", TraceContext{}, false},
+		{"00000000000000000000000000000000/1", "", TraceContext{}, false},
+		{"", "", TraceContext{}, false},
+	}
+
+	for i, tt := range tests {
+		h := make(http.Header)
+		if tt.cloudTrace != "" {
+			h.Set("X-Cloud-Trace-Context", tt.cloudTrace)
+		}
+		if tt.traceparent != "" {
+			h.Set("traceparent", tt.traceparent)
+		}
+
+		got, ok := parseTraceHeaders(h)
+		if ok != tt.ok {
+			t.Errorf("%d: ok mismatch; want %v, got %v", i, tt.ok, ok)
+			continue
+		}
+		if ok && got != tt.want {
+			t.Errorf("%d: trace context mismatch; want %+v, got %+v", i, tt.want, got)
+		}
+	}
+}
+
+func TestTransportTracePropagation(t *testing.T) {
+	var headers http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	httpClient := &http.Client{Transport: &Transport{}}
+
+	frontend := httptest.NewServer(TraceHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request, err := http.NewRequestWithContext(r.Context(), "GET", backend.URL, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		response, err := httpClient.Do(request)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		response.Body.Close()
+	})))
+	defer frontend.Close()
+
+	request, err := http.NewRequest("GET", frontend.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("X-Cloud-Trace-Context", testTraceID+"/123;o=1")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	cloudTrace, ok := parseCloudTraceContext(headers.Get("X-Cloud-Trace-Context"))
+	if !ok {
+		t.Fatalf("invalid X-Cloud-Trace-Context header: %q", headers.Get("X-Cloud-Trace-Context"))
+	}
+	if cloudTrace.TraceID != testTraceID || !cloudTrace.Sampled {
+		t.Errorf("X-Cloud-Trace-Context mismatch; got %+v", cloudTrace)
+	}
+	if cloudTrace.SpanID == 123 || cloudTrace.SpanID == 0 {
+		t.Errorf("expected a new child span ID; got %d", cloudTrace.SpanID)
+	}
+
+	traceparent, ok := parseTraceparent(headers.Get("traceparent"))
+	if !ok {
+		t.Fatalf("invalid traceparent header: %q", headers.Get("traceparent"))
+	}
+	if traceparent != cloudTrace {
+		t.Errorf("traceparent mismatch; want %+v, got %+v", cloudTrace, traceparent)
+	}
+}
+
+func TestTransportWithoutTraceContext(t *testing.T) {
+	var headers http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	request, err := http.NewRequestWithContext(context.Background(), "GET", backend.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := (&http.Client{Transport: &Transport{}}).Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	for name := range headers {
+		if strings.EqualFold(name, "traceparent") || strings.EqualFold(name, "X-Cloud-Trace-Context") {
+			t.Errorf("unexpected %s header", name)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// watchTimeout is how long the metadata server holds a wait-for-change
+// request open before returning the unchanged value.
+const watchTimeout = 60 * time.Second
+
+// ErrMetadataMissingETag is returned by WatchMetadata when the metadata
+// server does not return an ETag for the watched key.
+var ErrMetadataMissingETag = errors.New("run: metadata response missing etag")
+
+// A MetadataChange holds the value of a watched metadata key.
+type MetadataChange struct {
+	// Value is the current value of the key.
+	Value string
+
+	// ETag identifies the value. It changes whenever the value does.
+	ETag string
+
+	// Err is set when the watch fails. A change with Err set is
+	// always the last one delivered before the channel is closed.
+	Err error
+}
+
+// WatchMetadata watches the given metadata key using the metadata
+// server's wait-for-change protocol. See Metadata for the key format.
+//
+// The current value is delivered first, followed by each new value as
+// it changes. The returned channel is closed when ctx is done or after
+// an error is delivered.
+func WatchMetadata(ctx context.Context, key string) <-chan MetadataChange {
+	return DefaultEnvironment.WatchMetadata(ctx, key)
+}
+
+// WatchMetadata watches the given metadata key using the metadata
+// server's wait-for-change protocol.
+func (e *Environment) WatchMetadata(ctx context.Context, key string) <-chan MetadataChange {
+	changes := make(chan MetadataChange)
+	go e.watchMetadata(ctx, key, changes)
+	return changes
+}
+
+func (e *Environment) watchMetadata(ctx context.Context, key string, changes chan<- MetadataChange) {
+	defer close(changes)
+
+	send := func(change MetadataChange) bool {
+		select {
+		case changes <- change:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	var etag string
+	for {
+		endpoint := e.metadataURL(key)
+		if etag != "" {
+			endpoint = fmt.Sprintf("%s?wait_for_change=true&timeout_sec=%d&last_etag=%s",
+				endpoint, int(watchTimeout.Seconds()), url.QueryEscape(etag))
+		}
+
+		response, err := e.metadataGet(ctx, endpoint, watchTimeout+e.metadataTimeout())
+		if err != nil {
+			if ctx.Err() == nil {
+				send(MetadataChange{Err: err})
+			}
+			return
+		}
+
+		if response.etag == "" {
+			send(MetadataChange{Err: ErrMetadataMissingETag})
+			return
+		}
+
+		// The wait timed out without a change.
+		if response.etag == etag {
+			continue
+		}
+
+		etag = response.etag
+		if !send(MetadataChange{Value: string(response.data), ETag: etag}) {
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package run
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/run/internal/gcptest"
+)
+
+func receiveChange(t *testing.T, changes <-chan MetadataChange) MetadataChange {
+	t.Helper()
+
+	select {
+	case change, ok := <-changes:
+		if !ok {
+			t.Fatal("changes channel closed unexpectedly")
+		}
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for metadata change")
+	}
+
+	return MetadataChange{}
+}
+
+func TestWatchMetadata(t *testing.T) {
+	store := gcptest.NewMetadataStore()
+	store.Set("project/attributes/color", "blue")
+
+	ms := httptest.NewServer(store)
+	defer ms.Close()
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := e.WatchMetadata(ctx, "project/attributes/color")
+
+	change := receiveChange(t, changes)
+	if change.Err != nil {
+		t.Fatalf("unexpected error: %v", change.Err)
+	}
+	if change.Value != "blue" {
+		t.Errorf("want %v, got %v", "blue", change.Value)
+	}
+
+	first := change.ETag
+
+	store.Set("project/attributes/color", "green")
+
+	change = receiveChange(t, changes)
+	if change.Err != nil {
+		t.Fatalf("unexpected error: %v", change.Err)
+	}
+	if change.Value != "green" {
+		t.Errorf("want %v, got %v", "green", change.Value)
+	}
+	if change.ETag == first {
+		t.Errorf("etag did not change: %v", change.ETag)
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-changes:
+		if ok {
+			t.Error("expected changes channel to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for changes channel to close")
+	}
+}
+
+func TestWatchMetadataNotFound(t *testing.T) {
+	ms := httptest.NewServer(gcptest.NewMetadataStore())
+	defer ms.Close()
+
+	e := NewEnvironment()
+	e.MetadataEndpoint = ms.URL
+
+	changes := e.WatchMetadata(context.Background(), "notfound")
+
+	change := receiveChange(t, changes)
+	if !errors.Is(change.Err, ErrMetadataNotFound) {
+		t.Errorf("unexpected error, want %q, got %q", ErrMetadataNotFound, change.Err)
+	}
+
+	if _, ok := <-changes; ok {
+		t.Error("expected changes channel to be closed")
+	}
+}